@@ -1,16 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/RobustPerception/azure_metrics_exporter/config"
@@ -18,6 +17,12 @@ import (
 
 var (
 	apiVersionDate = regexp.MustCompile("^\\d{4}-\\d{2}-\\d{2}")
+
+	// Delay before retrying to get the metric definitions of a resource type after a failure
+	metricDefinitionsErrorTTL = time.Minute
+
+	// Maximum number of timeseries returned per metric split by dimensions, Azure returning only 10 by default
+	maxDimensionSeries = 1000
 )
 
 // AzureMetricDefinitionResponse represents metric definition response for a given resource from Azure.
@@ -45,17 +50,51 @@ type metricDefinitionResponse struct {
 	Unit                   string `json:"unit"`
 }
 
+// Returns the definition of the given metric, if any
+func (r *AzureMetricDefinitionResponse) definitionOf(metricName string) (metricDefinitionResponse, bool) {
+	for _, def := range r.MetricDefinitionResponses {
+		if strings.EqualFold(def.Name.Value, metricName) {
+			return def, true
+		}
+	}
+	return metricDefinitionResponse{}, false
+}
+
+// Returns whether metric values are available with the given time grain
+func (def *metricDefinitionResponse) supportsTimeGrain(interval time.Duration) bool {
+	for _, availability := range def.MetricAvailabilities {
+		timeGrain, err := parseISO8601Duration(availability.TimeGrain)
+		if err == nil && timeGrain == interval {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the finest time grain metric values are available with
+func (def *metricDefinitionResponse) finestTimeGrain() (time.Duration, bool) {
+	var finest time.Duration
+	for _, availability := range def.MetricAvailabilities {
+		timeGrain, err := parseISO8601Duration(availability.TimeGrain)
+		if err == nil && (finest == 0 || timeGrain < finest) {
+			finest = timeGrain
+		}
+	}
+	return finest, finest != 0
+}
+
 // AzureMetricValueResponse represents a metric value response for a given metric definition.
 type AzureMetricValueResponse struct {
 	Value []struct {
 		Timeseries []struct {
-			Data []struct {
-				TimeStamp string  `json:"timeStamp"`
-				Total     float64 `json:"total"`
-				Average   float64 `json:"average"`
-				Minimum   float64 `json:"minimum"`
-				Maximum   float64 `json:"maximum"`
-			} `json:"data"`
+			Metadatavalues []struct {
+				Name struct {
+					LocalizedValue string `json:"localizedValue"`
+					Value          string `json:"value"`
+				} `json:"name"`
+				Value string `json:"value"`
+			} `json:"metadatavalues"`
+			Data []metricDataPoint `json:"data"`
 		} `json:"timeseries"`
 		ID   string `json:"id"`
 		Name struct {
@@ -71,24 +110,111 @@ type AzureMetricValueResponse struct {
 	} `json:"error"`
 }
 
+// metricDataPoint holds the aggregated values of a metric over a time grain.
+// Aggregations that were not requested or have no value are nil.
+type metricDataPoint struct {
+	TimeStamp string   `json:"timeStamp"`
+	Total     *float64 `json:"total"`
+	Average   *float64 `json:"average"`
+	Minimum   *float64 `json:"minimum"`
+	Maximum   *float64 `json:"maximum"`
+	Count     *float64 `json:"count"`
+}
+
+// Returns the value of the given aggregation, nil if there is none
+func (d *metricDataPoint) valueOf(aggregation string) *float64 {
+	switch aggregation {
+	case "Total":
+		return d.Total
+	case "Average":
+		return d.Average
+	case "Minimum":
+		return d.Minimum
+	case "Maximum":
+		return d.Maximum
+	case "Count":
+		return d.Count
+	}
+	return nil
+}
+
+// Returns the last data point having a value for the given aggregation, and that value
+func lastValueOf(data []metricDataPoint, aggregation string) (metricDataPoint, float64, bool) {
+	for i := len(data) - 1; i >= 0; i-- {
+		if v := data[i].valueOf(aggregation); v != nil {
+			return data[i], *v, true
+		}
+	}
+	return metricDataPoint{}, 0, false
+}
+
+// AzureBatchMetricResponse represents the responses to a batch of metric queries, named after the index of
+// their request.
 type AzureBatchMetricResponse struct {
 	Responses []struct {
+		Name           string                   `json:"name"`
 		HttpStatusCode int                      `json:"httpStatusCode"`
 		Content        AzureMetricValueResponse `json:"content"`
 	} `json:"responses"`
 }
 
+// AzureBatchLookupResponse represents the responses to a batch of resource lookups, named after the index of
+// their request.
 type AzureBatchLookupResponse struct {
 	Responses []struct {
-		HttpStatusCode int           `json:"httpStatusCode"`
-		Content        AzureResource `json:"content"`
+		Name           string `json:"name"`
+		HttpStatusCode int    `json:"httpStatusCode"`
+		Content        struct {
+			AzureResource
+			APIError struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"content"`
 	} `json:"responses"`
 }
 
+// azureErrorResponse represents the error returned by Azure for a failed request.
+type azureErrorResponse struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
 type AzureResourceListResponse struct {
 	Value []AzureResource `json:"value"`
 }
 
+// AzureSubscriptionListResponse represents the list of subscriptions visible to the principal.
+type AzureSubscriptionListResponse struct {
+	Value []struct {
+		SubscriptionID string `json:"subscriptionId"`
+		DisplayName    string `json:"displayName"`
+		State          string `json:"state"`
+	} `json:"value"`
+}
+
+// AzureResourceGraphResponse represents a page of results of an Azure Resource Graph query.
+type AzureResourceGraphResponse struct {
+	TotalRecords int64                    `json:"totalRecords"`
+	Count        int64                    `json:"count"`
+	Data         []map[string]interface{} `json:"data"`
+	SkipToken    string                   `json:"$skipToken"`
+}
+
+type resourceGraphRequest struct {
+	Subscriptions []string                    `json:"subscriptions"`
+	Query         string                      `json:"query"`
+	Options       resourceGraphRequestOptions `json:"options"`
+}
+
+type resourceGraphRequestOptions struct {
+	ResultFormat string `json:"resultFormat"`
+	Top          int    `json:"$top"`
+	SkipToken    string `json:"$skipToken,omitempty"`
+}
+
 type AzureResource struct {
 	ID           string            `json:"id" pretty:"id"`
 	Name         string            `json:"name" pretty:"resource_name"`
@@ -166,120 +292,101 @@ func (m *APIVersionMap) findBy(resourceType string) string {
 
 // AzureClient represents our client to talk to the Azure api
 type AzureClient struct {
-	client               *http.Client
-	accessToken          string
-	accessTokenExpiresOn time.Time
-	APIVersions          APIVersionMap
+	client      *http.Client
+	tokens      *tokenSource
+	APIVersions APIVersionMap
+
+	// Tokens for the Azure Monitor metrics data plane, only used by the data_plane metrics backend
+	metricsTokens *tokenSource
+
+	// Metric definitions are the same for all resources of a type, they are cached by resource type
+	definitionsMtx    sync.Mutex
+	metricDefinitions map[string]*definitionsCall
 }
 
-// NewAzureClient returns an Azure client to talk the Azure API
-func NewAzureClient() *AzureClient {
-	return &AzureClient{
-		client:               &http.Client{},
-		accessToken:          "",
-		accessTokenExpiresOn: time.Time{},
-	}
+// definitionsCall gets the metric definitions of a resource type, shared by the collections needing them meanwhile.
+type definitionsCall struct {
+	done      chan struct{}
+	def       *AzureMetricDefinitionResponse
+	err       error
+	fetchedAt time.Time
 }
 
-func (ac *AzureClient) getAccessToken() error {
-	var resp *http.Response
-	var err error
-	if len(sc.C.Credentials.ClientID) == 0 {
-		log.Printf("Using managed identity")
-		target := fmt.Sprintf("http://169.254.169.254/metadata/identity/oauth2/token?resource=%s&api-version=2018-02-01", sc.C.ResourceManagerURL)
-		req, err := http.NewRequest("GET", target, nil)
-		if err != nil {
-			return fmt.Errorf("Error getting token against Azure MSI endpoint: %v", err)
-		}
-		req.Header.Add("Metadata", "true")
-		resp, err = ac.client.Do(req)
-	} else {
-		target := fmt.Sprintf("%s/%s/oauth2/token", sc.C.ActiveDirectoryAuthorityURL, sc.C.Credentials.TenantID)
-		form := url.Values{
-			"grant_type":    {"client_credentials"},
-			"resource":      {sc.C.ResourceManagerURL},
-			"client_id":     {sc.C.Credentials.ClientID},
-			"client_secret": {sc.C.Credentials.ClientSecret},
-		}
-		resp, err = ac.client.PostForm(target, form)
-	}
-	if err != nil {
-		return fmt.Errorf("Error authenticating against Azure API: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
-		respBytest, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("Did not get status code 200, got: %d with body: %s", resp.StatusCode, string(respBytest))
+// expired returns whether the call failed more than metricDefinitionsErrorTTL ago, and is to be retried.
+func (c *definitionsCall) expired() bool {
+	select {
+	case <-c.done:
+		return c.err != nil && time.Since(c.fetchedAt) >= metricDefinitionsErrorTTL
+	default:
+		return false
 	}
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("Error reading body of response: %v", err)
-	}
-	var data map[string]interface{}
-	err = json.Unmarshal(body, &data)
-	if err != nil {
-		return fmt.Errorf("Error unmarshalling response body: %v", err)
-	}
-	ac.accessToken = data["access_token"].(string)
-	expiresOn, err := strconv.ParseInt(data["expires_on"].(string), 10, 64)
-	if err != nil {
-		return fmt.Errorf("Error ParseInt of expires_on failed: %v", err)
+// NewAzureClient returns an Azure client to talk the Azure API
+func NewAzureClient() *AzureClient {
+	return &AzureClient{
+		client:            &http.Client{},
+		metricDefinitions: make(map[string]*definitionsCall),
 	}
-	ac.accessTokenExpiresOn = time.Unix(expiresOn, 0).UTC()
+}
 
-	return nil
+// Sets the credentials used to get tokens for Azure Resource Manager and the metrics data plane
+func (ac *AzureClient) setCredentials(credentials credentialProvider) {
+	ac.tokens = newTokenSource(credentials, sc.C.ResourceManagerURL)
+	ac.metricsTokens = newTokenSource(credentials, sc.C.MetricsDataPlaneAudience)
 }
 
 // Returns metric definitions for all configured target and resource groups
 func (ac *AzureClient) getMetricDefinitions() (map[string]AzureMetricDefinitionResponse, error) {
 	definitions := make(map[string]AzureMetricDefinitionResponse)
-	for _, target := range sc.C.Targets {
-		def, err := ac.getAzureMetricDefinitionResponse(target.Resource)
+	for i, target := range sc.C.Targets {
+		subscriptions, err := ac.subscriptionsFrom(fmt.Sprintf("targets[%d]", i), target.Subscriptions, false)
 		if err != nil {
 			return nil, err
 		}
-		definitions[target.Resource] = *def
+		for _, subscription := range subscriptions {
+			def, err := ac.getAzureMetricDefinitionResponse(subscription, target.Resource)
+			if err != nil {
+				return nil, err
+			}
+			definitions[fmt.Sprintf("/subscriptions/%s%s", subscription, target.Resource)] = *def
+		}
 	}
 
-	for _, resourceGroup := range sc.C.ResourceGroups {
-		resources, err := ac.filteredListFromResourceGroup(resourceGroup)
+	for i, resourceGroup := range sc.C.ResourceGroups {
+		subscriptions, err := ac.subscriptionsFrom(fmt.Sprintf("resource_groups[%d]", i), resourceGroup.Subscriptions, resourceGroup.AllSubscriptions)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to get resources for resource group %s and resource types %s: %v",
-				resourceGroup.ResourceGroup, resourceGroup.ResourceTypes, err)
+			return nil, err
 		}
-		for _, resource := range resources {
-			def, err := ac.getAzureMetricDefinitionResponse(resource.ID)
+		for _, subscription := range subscriptions {
+			resources, err := ac.filteredListFromResourceGroup(subscription, resourceGroup)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("Failed to get resources for resource group %s and resource types %s in subscription %s: %v",
+					resourceGroup.ResourceGroup, resourceGroup.ResourceTypes, subscription, err)
+			}
+			for _, resource := range resources {
+				def, err := ac.getAzureMetricDefinitionResponse(subscription, resource.ID)
+				if err != nil {
+					return nil, err
+				}
+				definitions[fmt.Sprintf("/subscriptions/%s%s", subscription, resource.ID)] = *def
 			}
-			definitions[resource.ID] = *def
 		}
 	}
 	return definitions, nil
 }
 
 // Returns AzureMetricDefinitionResponse for a given resource
-func (ac *AzureClient) getAzureMetricDefinitionResponse(resource string) (*AzureMetricDefinitionResponse, error) {
+func (ac *AzureClient) getAzureMetricDefinitionResponse(subscription string, resource string) (*AzureMetricDefinitionResponse, error) {
 	apiVersion := "2018-01-01"
 
-	metricsResource := fmt.Sprintf("subscriptions/%s%s", sc.C.Credentials.SubscriptionID, resource)
+	metricsResource := fmt.Sprintf("subscriptions/%s%s", subscription, resource)
 	metricsTarget := fmt.Sprintf("%s/%s/providers/microsoft.insights/metricDefinitions?api-version=%s", sc.C.ResourceManagerURL, metricsResource, apiVersion)
-	req, err := http.NewRequest("GET", metricsTarget, nil)
-	if err != nil {
-		return nil, fmt.Errorf("Error creating HTTP request: %v", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+ac.accessToken)
-	resp, err := ac.client.Do(req)
+	statusCode, body, err := ac.sendAzureRequest("GET", metricsTarget, nil, 1)
 	if err != nil {
-		return nil, fmt.Errorf("Error: %v", err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("Error reading body of response: %v", err)
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
+	if statusCode != http.StatusOK {
 		return nil, fmt.Errorf("Error: %v", string(body))
 	}
 
@@ -291,20 +398,55 @@ func (ac *AzureClient) getAzureMetricDefinitionResponse(resource string) (*Azure
 	return def, nil
 }
 
+// Returns the metric definitions of the type of the given resource, only querying Azure once per resource type.
+// Concurrent collections wait for the query in flight, and failures are only retried after metricDefinitionsErrorTTL.
+func (ac *AzureClient) getCachedMetricDefinitions(subscription string, resource string) (*AzureMetricDefinitionResponse, error) {
+	resourceType := strings.ToLower(GetResourceType(fmt.Sprintf("/subscriptions/%s%s/providers/microsoft.insights/metrics", subscription, resource)))
+
+	ac.definitionsMtx.Lock()
+	call, ok := ac.metricDefinitions[resourceType]
+	if !ok || call.expired() {
+		call = &definitionsCall{done: make(chan struct{})}
+		ac.metricDefinitions[resourceType] = call
+		ac.definitionsMtx.Unlock()
+
+		call.def, call.err = ac.getAzureMetricDefinitionResponse(subscription, resource)
+		call.fetchedAt = time.Now()
+		close(call.done)
+		return call.def, call.err
+	}
+	ac.definitionsMtx.Unlock()
+
+	<-call.done
+	return call.def, call.err
+}
+
 // Returns resource list resolved and filtered from resource_groups configuration
-func (ac *AzureClient) filteredListFromResourceGroup(resourceGroup config.ResourceGroup) ([]AzureResource, error) {
-	resources, err := ac.listFromResourceGroup(resourceGroup.ResourceGroup, resourceGroup.ResourceTypes)
+func (ac *AzureClient) filteredListFromResourceGroup(subscription string, resourceGroup config.ResourceGroup) ([]AzureResource, error) {
+	resources, err := ac.listFromResourceGroup(subscription, resourceGroup.ResourceGroup, resourceGroup.ResourceTypes)
 	if err != nil {
 		return nil, err
 	}
-	filteredResources := ac.filterResources(resources, resourceGroup)
+	filteredResources := ac.filterResources(resources, resourceGroup.ResourceNameIncludeRe, resourceGroup.ResourceNameExcludeRe, resourceGroup.Filter)
 
 	return filteredResources, nil
 }
 
-// Returns resource list filtered by tag name and tag value
-func (ac *AzureClient) filteredListByTag(resourceTag config.ResourceTag, resourcesMap map[string][]byte) ([]AzureResource, error) {
-	resources, err := ac.listByTag(resourceTag.ResourceTagName, resourceTag.ResourceTagValue, resourceTag.ResourceTypes, resourcesMap)
+// Returns the resources of the given types in the whole subscription, filtered by name
+func (ac *AzureClient) filteredListFromSubscription(subscription string, resourceType config.ResourceType) ([]AzureResource, error) {
+	resources, err := ac.listFromSubscription(subscription, resourceType.ResourceTypes)
+	if err != nil {
+		return nil, err
+	}
+	filteredResources := ac.filterResources(resources, resourceType.ResourceNameIncludeRe, resourceType.ResourceNameExcludeRe, resourceType.Filter)
+
+	return filteredResources, nil
+}
+
+// Returns resource list filtered by tag name and tag value. The list does not hold the tags of the resources,
+// the filter of the block is applied once they are looked up.
+func (ac *AzureClient) filteredListByTag(subscription string, resourceTag config.ResourceTag, responses *responseCache) ([]AzureResource, error) {
+	resources, err := ac.listByTag(subscription, resourceTag.ResourceTagName, resourceTag.ResourceTagValue, resourceTag.ResourceTypes, responses)
 	if err != nil {
 		return nil, err
 	}
@@ -312,18 +454,37 @@ func (ac *AzureClient) filteredListByTag(resourceTag config.ResourceTag, resourc
 }
 
 // Returns all resources for given resource group and types
-func (ac *AzureClient) listFromResourceGroup(resourceGroup string, resourceTypes []string) ([]AzureResource, error) {
+func (ac *AzureClient) listFromResourceGroup(subscriptionID string, resourceGroup string, resourceTypes []string) ([]AzureResource, error) {
 	apiVersion := "2018-02-01"
 
-	var filterTypesElements []string
-	for _, filterType := range resourceTypes {
-		filterTypesElements = append(filterTypesElements, fmt.Sprintf("resourcetype eq '%s'", filterType))
+	filterTypes := resourceTypesFilter(resourceTypes)
+	subscription := fmt.Sprintf("subscriptions/%s", subscriptionID)
+	resourcesEndpoint := fmt.Sprintf("%s/%s/resourceGroups/%s/resources?api-version=%s", sc.C.ResourceManagerURL, subscription, resourceGroup, apiVersion)
+	if len(filterTypes) > 0 {
+		resourcesEndpoint += "&$filter=" + filterTypes
+	}
+
+	body, err := getAllPages(resourcesEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var data AzureResourceListResponse
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
 	}
-	filterTypes := url.QueryEscape(strings.Join(filterTypesElements, " or "))
-	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
-	resourcesEndpoint := fmt.Sprintf("%s/%s/resourceGroups/%s/resources?api-version=%s&$filter=%s", sc.C.ResourceManagerURL, subscription, resourceGroup, apiVersion, filterTypes)
+	return data.extendResources(subscriptionID), nil
+}
+
+// Returns the resources of the given types in the whole subscription
+func (ac *AzureClient) listFromSubscription(subscriptionID string, resourceTypes []string) ([]AzureResource, error) {
+	apiVersion := "2018-02-01"
 
-	body, err := getAzureMonitorResponse(resourcesEndpoint)
+	subscription := fmt.Sprintf("subscriptions/%s", subscriptionID)
+	resourcesEndpoint := fmt.Sprintf("%s/%s/resources?api-version=%s&$filter=%s", sc.C.ResourceManagerURL, subscription, apiVersion, resourceTypesFilter(resourceTypes))
+
+	body, err := getAllPages(resourcesEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -333,26 +494,59 @@ func (ac *AzureClient) listFromResourceGroup(resourceGroup string, resourceTypes
 	if err != nil {
 		return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
 	}
-	return data.extendResources(), nil
+	return data.extendResources(subscriptionID), nil
+}
+
+// Returns the escaped $filter selecting resources of any of the given types
+func resourceTypesFilter(resourceTypes []string) string {
+	var filterTypesElements []string
+	for _, filterType := range resourceTypes {
+		filterTypesElements = append(filterTypesElements, fmt.Sprintf("resourcetype eq '%s'", filterType))
+	}
+	return url.QueryEscape(strings.Join(filterTypesElements, " or "))
+}
+
+// responseCache holds the response bodies of list requests by endpoint, so that blocks listing
+// the same resources during a collection share a single request.
+type responseCache struct {
+	sync.Mutex
+	bodies map[string][]byte
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{bodies: make(map[string][]byte)}
+}
+
+func (c *responseCache) get(endpoint string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	body, ok := c.bodies[endpoint]
+	return body, ok
+}
+
+func (c *responseCache) set(endpoint string, body []byte) {
+	c.Lock()
+	defer c.Unlock()
+	c.bodies[endpoint] = body
 }
 
 // Returns all resource with the given couple tagname, tagvalue
-func (ac *AzureClient) listByTag(tagName string, tagValue string, types []string, resourcesMap map[string][]byte) ([]AzureResource, error) {
+func (ac *AzureClient) listByTag(subscriptionID string, tagName string, tagValue string, types []string, responses *responseCache) ([]AzureResource, error) {
 	apiVersion := "2018-05-01"
 	securedTagName := secureString(tagName)
 	securedTagValue := secureString(tagValue)
 	filterTypes := url.QueryEscape(fmt.Sprintf("tagName eq '%s' and tagValue eq '%s'", securedTagName, securedTagValue))
-	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
+	subscription := fmt.Sprintf("subscriptions/%s", subscriptionID)
 	resourcesEndpoint := fmt.Sprintf("%s/%s/resources?api-version=%s&$filter=%s", sc.C.ResourceManagerURL, subscription, apiVersion, filterTypes)
 
-	body, ok := resourcesMap[resourcesEndpoint]
+	body, ok := responses.get(resourcesEndpoint)
 	if !ok {
 		var err error
-		body, err = getAzureMonitorResponse(resourcesEndpoint)
+		body, err = getAllPages(resourcesEndpoint)
 		if err != nil {
 			return nil, err
 		}
-		resourcesMap[resourcesEndpoint] = body
+		responses.set(resourcesEndpoint, body)
 	}
 
 	var data AzureResourceListResponse
@@ -364,17 +558,30 @@ func (ac *AzureClient) listByTag(tagName string, tagValue string, types []string
 	if len(types) > 0 {
 		data.Value = data.filterTypesInResourceList(types)
 	}
-	return data.extendResources(), nil
+	return data.extendResources(subscriptionID), nil
 }
 
 func (ac *AzureClient) listAPIVersions() error {
 	apiVersion := "2019-05-10"
 	var versionResponse APIVersionResponse
 
-	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
+	// API versions are the same across subscriptions, query the first one available
+	subscriptionID := sc.C.Credentials.SubscriptionID
+	if len(subscriptionID) == 0 {
+		subscriptions, err := ac.listSubscriptions()
+		if err != nil {
+			return err
+		}
+		if len(subscriptions) == 0 {
+			return fmt.Errorf("No subscription found to list API versions")
+		}
+		subscriptionID = subscriptions[0]
+	}
+
+	subscription := fmt.Sprintf("subscriptions/%s", subscriptionID)
 	resourcesEndpoint := fmt.Sprintf("%s/%s/providers?api-version=%s", sc.C.ResourceManagerURL, subscription, apiVersion)
 
-	body, err := getAzureMonitorResponse(resourcesEndpoint)
+	body, err := getAllPages(resourcesEndpoint)
 	if err != nil {
 		return err
 	}
@@ -388,6 +595,93 @@ func (ac *AzureClient) listAPIVersions() error {
 	return nil
 }
 
+// Returns the IDs of all enabled subscriptions visible to the principal
+func (ac *AzureClient) listSubscriptions() ([]string, error) {
+	apiVersion := "2019-06-01"
+	subscriptionsEndpoint := fmt.Sprintf("%s/subscriptions?api-version=%s", strings.TrimSuffix(sc.C.ResourceManagerURL, "/"), apiVersion)
+
+	body, err := getAllPages(subscriptionsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var data AzureSubscriptionListResponse
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+	}
+
+	var subscriptions []string
+	for _, s := range data.Value {
+		if s.State == "Disabled" || s.State == "Deleted" {
+			continue
+		}
+		subscriptions = append(subscriptions, s.SubscriptionID)
+	}
+	return subscriptions, nil
+}
+
+// Returns the subscriptions to query for a configuration block, defaulting to the credentials subscription
+func (ac *AzureClient) subscriptionsFrom(block string, subscriptions []string, allSubscriptions bool) ([]string, error) {
+	if allSubscriptions {
+		// The visible subscriptions are shared by every block, and cached like discovered resources
+		visible, err := discoveries.get(block, "subscriptions", func() (interface{}, error) {
+			return ac.listSubscriptions()
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list subscriptions: %v", err)
+		}
+		return visible.([]string), nil
+	}
+	if len(subscriptions) > 0 {
+		return subscriptions, nil
+	}
+	return []string{sc.C.Credentials.SubscriptionID}, nil
+}
+
+// Returns the rows of an Azure Resource Graph query over the given subscriptions, following pagination
+func (ac *AzureClient) queryResources(subscriptions []string, query string) ([]map[string]interface{}, error) {
+	apiVersion := "2021-03-01"
+	queryEndpoint := fmt.Sprintf("%s/providers/Microsoft.ResourceGraph/resources?api-version=%s", strings.TrimSuffix(sc.C.ResourceManagerURL, "/"), apiVersion)
+
+	request := resourceGraphRequest{
+		Subscriptions: subscriptions,
+		Query:         query,
+		Options: resourceGraphRequestOptions{
+			ResultFormat: "objectArray",
+			Top:          1000,
+		},
+	}
+
+	var rows []map[string]interface{}
+	for {
+		requestJSON, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+
+		statusCode, body, err := ac.sendAzureRequest("POST", queryEndpoint, requestJSON, 1)
+		if err != nil {
+			return nil, err
+		}
+		if statusCode != 200 {
+			return nil, fmt.Errorf("Unable to query resource graph with status code: %d and with body: %s", statusCode, body)
+		}
+
+		var data AzureResourceGraphResponse
+		err = json.Unmarshal(body, &data)
+		if err != nil {
+			return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+		}
+
+		rows = append(rows, data.Data...)
+		if data.SkipToken == "" {
+			return rows, nil
+		}
+		request.Options.SkipToken = data.SkipToken
+	}
+}
+
 func (response *AzureResourceListResponse) filterTypesInResourceList(types []string) []AzureResource {
 	typesMap := make(map[string]struct{})
 	for _, resourceType := range types {
@@ -408,47 +702,68 @@ func secureString(value string) string {
 }
 
 func getAzureMonitorResponse(azureManagementEndpoint string) ([]byte, error) {
-	req, err := http.NewRequest("GET", azureManagementEndpoint, nil)
-	if err != nil {
-		return nil, fmt.Errorf("Error creating HTTP request: %v", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+ac.accessToken)
-	resp, err := ac.client.Do(req)
+	statusCode, body, err := ac.sendAzureRequest("GET", azureManagementEndpoint, nil, 1)
 	if err != nil {
-		return nil, fmt.Errorf("Error: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Unable to query API with status code: %d and with body: %s", resp.StatusCode, body)
+	if statusCode != 200 {
+		return nil, fmt.Errorf("Unable to query API with status code: %d and with body: %s", statusCode, body)
 	}
+	return body, nil
+}
 
-	if err != nil {
-		return nil, fmt.Errorf("Error reading body of response: %v", err)
+// pagedResponse is a page of an Azure Resource Manager list response.
+type pagedResponse struct {
+	Value    []json.RawMessage `json:"value"`
+	NextLink string            `json:"nextLink,omitempty"`
+}
+
+// getAllPages returns the body of a list response holding the values of all its pages, following nextLink.
+func getAllPages(azureManagementEndpoint string) ([]byte, error) {
+	var values []json.RawMessage
+	visited := make(map[string]bool)
+	for endpoint := azureManagementEndpoint; endpoint != "" && !visited[endpoint]; {
+		visited[endpoint] = true
+		body, err := getAzureMonitorResponse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		var page pagedResponse
+		err = json.Unmarshal(body, &page)
+		if err != nil {
+			return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+		}
+		values = append(values, page.Value...)
+		endpoint = page.NextLink
 	}
-	return body, err
+	return json.Marshal(pagedResponse{Value: values})
 }
 
-func (ar *AzureResourceListResponse) extendResources() []AzureResource {
-	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
+func (ar *AzureResourceListResponse) extendResources(subscriptionID string) []AzureResource {
+	subscription := fmt.Sprintf("subscriptions/%s", subscriptionID)
 	var subscriptionPrefixLen = len(subscription) + 1
 
 	for i, val := range ar.Value {
 		ar.Value[i].ID = val.ID[subscriptionPrefixLen:]
-		ar.Value[i].Subscription = sc.C.Credentials.SubscriptionID
+		ar.Value[i].Subscription = subscriptionID
 	}
 	return ar.Value
 }
 
-// Returns a filtered resource list based on a given resource list and regular expressions from the configuration
-func (ac *AzureClient) filterResources(resources []AzureResource, resourceGroup config.ResourceGroup) []AzureResource {
+// Returns a filtered resource list based on a given resource list, name regular expressions and filter from the configuration
+func (ac *AzureClient) filterResources(resources []AzureResource, includeRe []config.Regexp, excludeRe []config.Regexp, filter config.ResourceFilter) []AzureResource {
 	filteredResources := []AzureResource{}
 
 	for _, resource := range resources {
-		if len(resourceGroup.ResourceNameIncludeRe) != 0 {
+		if !matchesFilter(resource, filter) {
+			continue
+		}
+
+		if len(includeRe) != 0 {
 			include := false
-			for _, rx := range resourceGroup.ResourceNameIncludeRe {
+			for _, rx := range includeRe {
 				if rx.MatchString(resource.Name) {
 					include = true
 					break
@@ -460,7 +775,7 @@ func (ac *AzureClient) filterResources(resources []AzureResource, resourceGroup
 		}
 
 		exclude := false
-		for _, rx := range resourceGroup.ResourceNameExcludeRe {
+		for _, rx := range excludeRe {
 			if rx.MatchString(resource.Name) {
 				exclude = true
 				break
@@ -475,14 +790,91 @@ func (ac *AzureClient) filterResources(resources []AzureResource, resourceGroup
 	return filteredResources
 }
 
+// Returns whether the resource matches the tags, locations, resource group and type of the filter
+func matchesFilter(resource AzureResource, filter config.ResourceFilter) bool {
+	if len(filter.Tags) > 0 {
+		matched := 0
+		for _, tag := range filter.Tags {
+			if matchesTag(resource.Tags, tag) {
+				matched++
+			}
+		}
+		if filter.TagsMatch == config.TagsMatchAny && matched == 0 {
+			return false
+		}
+		if filter.TagsMatch != config.TagsMatchAny && matched < len(filter.Tags) {
+			return false
+		}
+	}
+
+	if len(filter.LocationInclude) > 0 && !containsFold(filter.LocationInclude, resource.Location) {
+		return false
+	}
+	if containsFold(filter.LocationExclude, resource.Location) {
+		return false
+	}
+
+	if len(filter.ResourceGroupRe) > 0 && !matchesAny(filter.ResourceGroupRe, resourceGroupOf(resource.ID)) {
+		return false
+	}
+	if len(filter.ResourceTypeRe) > 0 && !matchesAny(filter.ResourceTypeRe, resource.Type) {
+		return false
+	}
+	return true
+}
+
+// Returns whether the tags of a resource match a tag filter. Tag names are case insensitive.
+func matchesTag(tags map[string]string, filter config.TagFilter) bool {
+	var value string
+	present := false
+	for name, v := range tags {
+		if strings.EqualFold(name, filter.Name) {
+			value = v
+			present = true
+			break
+		}
+	}
+
+	switch {
+	case filter.Absent:
+		return !present
+	case !present:
+		return false
+	case len(filter.Value) > 0:
+		return value == filter.Value
+	case filter.ValueRe != nil:
+		return filter.ValueRe.MatchString(value)
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAny(regexps []config.Regexp, value string) bool {
+	for _, rx := range regexps {
+		if rx.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshAccessToken makes sure valid tokens are available, refreshing them if they are about to expire.
 func (ac *AzureClient) refreshAccessToken() error {
-	now := time.Now().UTC()
-	refreshAt := ac.accessTokenExpiresOn.Add(-10 * time.Minute)
+	if _, err := ac.tokens.get(); err != nil {
+		return fmt.Errorf("Error refreshing access token: %v", err)
+	}
 
-	if now.After(refreshAt) {
-		err := ac.getAccessToken()
-		if err != nil {
-			return fmt.Errorf("Error refreshing access token: %v", err)
+	if usesDataPlane() {
+		if _, err := ac.metricsTokens.get(); err != nil {
+			return fmt.Errorf("Error refreshing metrics data plane access token: %v", err)
 		}
 	}
 	return nil
@@ -493,20 +885,21 @@ type batchBody struct {
 }
 
 type batchRequest struct {
+	Name        string `json:"name"`
 	RelativeURL string `json:"relativeUrl"`
 	Method      string `json:"httpMethod"`
 }
 
-func resourceURLFrom(resource string, metricNames string, aggregations []string) string {
+func resourceURLFrom(subscription string, resource string, metricNames string, dimensions []string, aggregations []string, window queryWindow) string {
 	apiVersion := "2018-01-01"
 
 	path := fmt.Sprintf(
 		"/subscriptions/%s%s/providers/microsoft.insights/metrics",
-		sc.C.Credentials.SubscriptionID,
+		subscription,
 		resource,
 	)
 
-	endTime, startTime := GetTimes()
+	endTime, startTime := GetTimes(window.timespan, window.delay)
 
 	values := url.Values{}
 	if metricNames != "" {
@@ -515,7 +908,14 @@ func resourceURLFrom(resource string, metricNames string, aggregations []string)
 	filtered := filterAggregations(aggregations)
 	values.Add("aggregation", strings.Join(filtered, ","))
 	values.Add("timespan", fmt.Sprintf("%s/%s", startTime, endTime))
+	if window.interval != 0 {
+		values.Add("interval", formatISO8601Duration(window.interval))
+	}
 	values.Add("api-version", apiVersion)
+	if len(dimensions) > 0 {
+		values.Add("$filter", dimensionsFilter(dimensions))
+		values.Add("top", strconv.Itoa(maxDimensionSeries))
+	}
 
 	url := url.URL{
 		Path:     path,
@@ -524,6 +924,15 @@ func resourceURLFrom(resource string, metricNames string, aggregations []string)
 	return url.String()
 }
 
+// Returns the filter splitting metrics by all values of the given dimensions
+func dimensionsFilter(dimensions []string) string {
+	var filters []string
+	for _, dimension := range dimensions {
+		filters = append(filters, fmt.Sprintf("%s eq '*'", secureString(dimension)))
+	}
+	return strings.Join(filters, " and ")
+}
+
 func (ac *AzureClient) getBatchResponseBody(urls []string) ([]byte, error) {
 
 	rmBaseURL := sc.C.ResourceManagerURL
@@ -533,9 +942,11 @@ func (ac *AzureClient) getBatchResponseBody(urls []string) ([]byte, error) {
 
 	apiURL := fmt.Sprintf("%sbatch?api-version=2017-03-01", rmBaseURL)
 
+	// Requests are named after their index, as responses may not come back in the order of the requests
 	batch := batchBody{}
-	for _, u := range urls {
+	for i, u := range urls {
 		batch.Requests = append(batch.Requests, batchRequest{
+			Name:        strconv.Itoa(i),
 			RelativeURL: u,
 			Method:      "GET",
 		})
@@ -546,22 +957,36 @@ func (ac *AzureClient) getBatchResponseBody(urls []string) ([]byte, error) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(batchJSON))
+	// Each request of a batch counts against the Azure read limits
+	statusCode, body, err := ac.sendAzureRequest("POST", apiURL, batchJSON, len(urls))
 	if err != nil {
-		return nil, fmt.Errorf("Error creating HTTP request: %v", err)
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+ac.accessToken)
+	if !isSuccessStatus(statusCode) {
+		return nil, fmt.Errorf("Error sending batch request, got status code %d: %s", statusCode, errorMessageOf(body))
+	}
+	return body, nil
+}
 
-	resp, err := ac.client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Error: %v", err)
+// Returns whether a status code reports a successful request
+func isSuccessStatus(statusCode int) bool {
+	return statusCode >= 200 && statusCode < 300
+}
+
+// Returns the message of an Azure error response, or the raw body if it isn't one
+func errorMessageOf(body []byte) string {
+	var errorData azureErrorResponse
+	if err := json.Unmarshal(body, &errorData); err != nil || errorData.Error.Message == "" {
+		return string(body)
 	}
-	defer resp.Body.Close()
+	return fmt.Sprintf("%s: %s", errorData.Error.Code, errorData.Error.Message)
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// Returns the index of the request a batch response answers, from the name of the response
+func batchResponseIndex(name string, requests int) (int, bool) {
+	i, err := strconv.Atoi(name)
+	if err != nil || i < 0 || i >= requests {
+		return 0, false
 	}
-	return body, nil
+	return i, true
 }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+)
+
+func TestLastValueOf(t *testing.T) {
+	body := `[
+		{"timeStamp": "2019-10-01T10:00:00Z", "total": 12, "count": 4, "average": 3},
+		{"timeStamp": "2019-10-01T10:01:00Z", "total": 0, "count": 0},
+		{"timeStamp": "2019-10-01T10:02:00Z"}
+	]`
+	var data []metricDataPoint
+	if err := json.Unmarshal([]byte(body), &data); err != nil {
+		t.Fatal(err)
+	}
+
+	var cases = []struct {
+		aggregation string
+		timeStamp   string
+		value       float64
+		ok          bool
+	}{
+		{"Total", "2019-10-01T10:01:00Z", 0, true},
+		{"Count", "2019-10-01T10:01:00Z", 0, true},
+		{"Average", "2019-10-01T10:00:00Z", 3, true},
+		{"Maximum", "", 0, false},
+	}
+
+	for _, c := range cases {
+		dataPoint, value, ok := lastValueOf(data, c.aggregation)
+
+		if ok != c.ok || value != c.value || dataPoint.TimeStamp != c.timeStamp {
+			t.Errorf("doesn't find expected value for %s\ngot: %v %v %v\nwant: %v %v %v",
+				c.aggregation, dataPoint.TimeStamp, value, ok, c.timeStamp, c.value, c.ok)
+		}
+	}
+}
+
+func TestResourceTypesFilter(t *testing.T) {
+	var cases = []struct {
+		types []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"Microsoft.Compute/virtualMachines"}, "resourcetype+eq+%27Microsoft.Compute%2FvirtualMachines%27"},
+		{
+			[]string{"Microsoft.Compute/virtualMachines", "Microsoft.Sql/servers"},
+			"resourcetype+eq+%27Microsoft.Compute%2FvirtualMachines%27+or+resourcetype+eq+%27Microsoft.Sql%2Fservers%27",
+		},
+	}
+
+	for _, c := range cases {
+		got := resourceTypesFilter(c.types)
+		if got != c.want {
+			t.Errorf("doesn't build expected resource types filter\ngot: %v\nwant: %v", got, c.want)
+		}
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	newRegexp := func(s string) config.Regexp {
+		return config.Regexp{Regexp: regexp.MustCompile("^(?:" + s + ")$")}
+	}
+	resource := AzureResource{
+		ID:       "/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+		Location: "westeurope",
+		Type:     "Microsoft.Compute/virtualMachines",
+		Tags:     map[string]string{"Env": "prod", "team": "web"},
+	}
+	envRe := newRegexp("prod|staging")
+
+	var cases = []struct {
+		filter config.ResourceFilter
+		want   bool
+	}{
+		{config.ResourceFilter{}, true},
+		{config.ResourceFilter{Tags: []config.TagFilter{{Name: "env", Value: "prod"}, {Name: "team"}}}, true},
+		{config.ResourceFilter{Tags: []config.TagFilter{{Name: "env", Value: "prod"}, {Name: "owner"}}}, false},
+		{config.ResourceFilter{Tags: []config.TagFilter{{Name: "env", Value: "dev"}, {Name: "team"}}, TagsMatch: config.TagsMatchAny}, true},
+		{config.ResourceFilter{Tags: []config.TagFilter{{Name: "env", Value: "dev"}, {Name: "owner"}}, TagsMatch: config.TagsMatchAny}, false},
+		{config.ResourceFilter{Tags: []config.TagFilter{{Name: "env", ValueRe: &envRe}}}, true},
+		{config.ResourceFilter{Tags: []config.TagFilter{{Name: "owner", Absent: true}}}, true},
+		{config.ResourceFilter{Tags: []config.TagFilter{{Name: "team", Absent: true}}}, false},
+		{config.ResourceFilter{LocationInclude: []string{"WestEurope", "northeurope"}}, true},
+		{config.ResourceFilter{LocationInclude: []string{"northeurope"}}, false},
+		{config.ResourceFilter{LocationExclude: []string{"westeurope"}}, false},
+		{config.ResourceFilter{ResourceGroupRe: []config.Regexp{newRegexp("prod-.*")}}, true},
+		{config.ResourceFilter{ResourceGroupRe: []config.Regexp{newRegexp("test-.*")}}, false},
+		{config.ResourceFilter{ResourceTypeRe: []config.Regexp{newRegexp("Microsoft.Compute/.*")}}, true},
+		{config.ResourceFilter{ResourceTypeRe: []config.Regexp{newRegexp("Microsoft.Sql/.*")}}, false},
+	}
+
+	for _, c := range cases {
+		got := matchesFilter(resource, c.filter)
+		if got != c.want {
+			t.Errorf("doesn't match filter %+v as expected\ngot: %v\nwant: %v", c.filter, got, c.want)
+		}
+	}
+}
+
+func TestGetCachedMetricDefinitions(t *testing.T) {
+	previousRetries := maxRetries
+	maxRetries = 0
+	defer func() { maxRetries = previousRetries }()
+
+	var requests int32
+	var failing int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "bad request")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, `{"value": [{"name": {"value": "Percentage CPU"}}]}`)
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL}
+	defer func() { sc.C = previous }()
+
+	client := NewAzureClient()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm%d", i)
+			if def, err := client.getCachedMetricDefinitions("sub", id); err != nil || len(def.MetricDefinitionResponses) != 1 {
+				t.Errorf("doesn't get the metric definitions\ngot: %v, %v", def, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("doesn't query the definitions of a resource type once\ngot: %d requests\nwant: %d", n, 1)
+	}
+
+	// Failures are cached until metricDefinitionsErrorTTL expires
+	atomic.StoreInt32(&failing, 1)
+	atomic.StoreInt32(&requests, 0)
+	id := "/resourceGroups/rg/providers/Microsoft.Storage/storageAccounts/sa"
+	for i := 0; i < 2; i++ {
+		if _, err := client.getCachedMetricDefinitions("sub", id); err == nil {
+			t.Errorf("doesn't return the error getting the definitions")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("doesn't cache failures\ngot: %d requests\nwant: %d", n, 1)
+	}
+
+	previousTTL := metricDefinitionsErrorTTL
+	metricDefinitionsErrorTTL = 0
+	defer func() { metricDefinitionsErrorTTL = previousTTL }()
+	client.getCachedMetricDefinitions("sub", id)
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("doesn't retry failures once expired\ngot: %d requests\nwant: %d", n, 2)
+	}
+}
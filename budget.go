@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	errBudgetExhausted = errors.New("API budget exhausted")
+
+	budgetRemainingDesc = prometheus.NewDesc(
+		"azure_api_budget_remaining_requests",
+		"Requests to Azure that can be made before the client-side API budget is exhausted",
+		nil, nil,
+	)
+	budgetExhaustedDesc = prometheus.NewDesc(
+		"azure_api_budget_exhausted_total",
+		"Number of requests to Azure refused because the client-side API budget was exhausted",
+		nil, nil,
+	)
+)
+
+// apiBudget is a token bucket limiting the rate of requests made to Azure. A nil budget is unlimited.
+type apiBudget struct {
+	mtx       sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	reserve   float64
+	tokens    float64
+	last      time.Time
+	exhausted float64
+}
+
+// newAPIBudget returns the budget configured by c, or nil if requests are not limited.
+func newAPIBudget(c config.APIBudget) *apiBudget {
+	if c.RequestsPerHour == 0 {
+		return nil
+	}
+
+	burst := float64(c.Burst)
+	if burst == 0 {
+		burst = float64(c.RequestsPerHour) / 60
+	}
+	reserve := float64(c.Reserve)
+	if reserve == 0 {
+		reserve = burst / 10
+	}
+	return &apiBudget{
+		rate:    float64(c.RequestsPerHour) / 3600,
+		burst:   burst,
+		reserve: reserve,
+		tokens:  burst,
+		last:    time.Now(),
+	}
+}
+
+// refill adds the tokens earned since the last refill. Must be called with the lock held.
+func (b *apiBudget) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// take consumes n tokens, returning false without consuming any if fewer are available.
+// A batch costing more than the burst is allowed once the budget is full, going into debt,
+// as it could otherwise never be sent.
+func (b *apiBudget) take(n int) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	if b.tokens < math.Min(float64(n), b.burst) {
+		b.exhausted++
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// isExhausted returns whether not a single request can currently be made.
+func (b *apiBudget) isExhausted() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	return b.tokens < 1
+}
+
+// isLow returns whether the remaining requests are within the reserve kept for the highest priority blocks.
+func (b *apiBudget) isLow() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	return b.tokens < b.reserve || b.tokens < 1
+}
+
+// Describe implemented with dummy data to satisfy interface.
+func (b *apiBudget) Describe(ch chan<- *prometheus.Desc) {
+	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
+}
+
+// Collect - serve the remaining requests and refused requests of the budget.
+func (b *apiBudget) Collect(ch chan<- prometheus.Metric) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	ch <- prometheus.MustNewConstMetric(budgetRemainingDesc, prometheus.GaugeValue, b.tokens)
+	ch <- prometheus.MustNewConstMetric(budgetExhaustedDesc, prometheus.CounterValue, b.exhausted)
+}
+
+// Returns whether a block should be skipped to keep the remaining API budget for blocks of higher priority
+func skipForBudget(b *collectionBlock) bool {
+	if !onBudgetExhausted(config.BudgetSkipLowPriority) || !budget.isLow() {
+		return false
+	}
+	for _, other := range collectionBlocksFrom(sc.C) {
+		if other.priority > b.priority {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the configured behaviour when the API budget is exhausted is the given one
+func onBudgetExhausted(behaviour string) bool {
+	if sc.C.APIBudget.OnExhausted == "" {
+		return behaviour == config.BudgetFail
+	}
+	return sc.C.APIBudget.OnExhausted == behaviour
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+)
+
+func TestAPIBudgetTake(t *testing.T) {
+	if b := newAPIBudget(config.APIBudget{}); b != nil || !b.take(1000) || b.isExhausted() {
+		t.Errorf("doesn't leave requests unlimited without a budget")
+	}
+
+	b := newAPIBudget(config.APIBudget{RequestsPerHour: 3600, Burst: 20})
+	if !b.take(20) {
+		t.Errorf("doesn't allow a burst of requests")
+	}
+	if b.take(1) || !b.isExhausted() {
+		t.Errorf("doesn't refuse requests over the budget")
+	}
+	if b.exhausted != 1 {
+		t.Errorf("doesn't count refused requests\ngot: %v\nwant: %v", b.exhausted, 1)
+	}
+
+	// One request per second is earned back
+	b.last = b.last.Add(-5 * time.Second)
+	if !b.take(5) {
+		t.Errorf("doesn't refill the budget over time")
+	}
+
+	b.last = b.last.Add(-time.Hour)
+	b.take(0)
+	if b.tokens != 20 {
+		t.Errorf("doesn't cap the budget to the burst\ngot: %v\nwant: %v", b.tokens, 20)
+	}
+
+	// A batch costing more than the burst is sent once the budget is full, and paid back before the next request
+	b = newAPIBudget(config.APIBudget{RequestsPerHour: 600, Burst: 10})
+	if !b.take(20) {
+		t.Errorf("doesn't allow a batch costing more than the burst")
+	}
+	if b.tokens != -10 {
+		t.Errorf("doesn't go into debt for a batch costing more than the burst\ngot: %v\nwant: %v", b.tokens, -10)
+	}
+	if b.take(1) {
+		t.Errorf("doesn't refuse requests until the debt is paid back")
+	}
+	b.last = b.last.Add(-2 * time.Minute)
+	if !b.take(1) {
+		t.Errorf("doesn't allow requests once the debt is paid back")
+	}
+}
@@ -6,18 +6,36 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/prometheus/common/model"
 	yaml "gopkg.in/yaml.v2"
 )
 
 // Config - Azure exporter configuration
 type Config struct {
-	ActiveDirectoryAuthorityURL string          `yaml:"active_directory_authority_url"`
-	ResourceManagerURL          string          `yaml:"resource_manager_url"`
-	Credentials                 Credentials     `yaml:"credentials"`
-	Targets                     []Target        `yaml:"targets"`
-	ResourceGroups              []ResourceGroup `yaml:"resource_groups"`
-	ResourceTags                []ResourceTag   `yaml:"resource_tags"`
+	ActiveDirectoryAuthorityURL string            `yaml:"active_directory_authority_url"`
+	ResourceManagerURL          string            `yaml:"resource_manager_url"`
+	Credentials                 Credentials       `yaml:"credentials"`
+	Targets                     []Target          `yaml:"targets"`
+	ResourceGroups              []ResourceGroup   `yaml:"resource_groups"`
+	ResourceTags                []ResourceTag     `yaml:"resource_tags"`
+	ResourceQueries             []ResourceQuery   `yaml:"resource_queries"`
+	ResourceTypes               []ResourceType    `yaml:"resource_types"`
+	Modules                     map[string]Module `yaml:"modules"`
+	CollectionInterval          model.Duration    `yaml:"collection_interval"`
+	UseAzureTimestamps          bool              `yaml:"use_azure_timestamps"`
+	MetricNaming                string            `yaml:"metric_naming"`
+	MetricNamespace             string            `yaml:"metric_namespace"`
+	Interval                    model.Duration    `yaml:"interval"`
+	Timespan                    model.Duration    `yaml:"timespan"`
+	Delay                       model.Duration    `yaml:"delay"`
+	DiscoveryCacheTTL           model.Duration    `yaml:"discovery_cache_ttl"`
+	APIBudget                   APIBudget         `yaml:"api_budget"`
+	MaxConcurrentRequests       int               `yaml:"max_concurrent_requests"`
+	MetricsBackend              string            `yaml:"metrics_backend"`
+	MetricsDataPlaneURL         string            `yaml:"metrics_data_plane_url"`
+	MetricsDataPlaneAudience    string            `yaml:"metrics_data_plane_audience"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline"`
@@ -34,6 +52,10 @@ func (sc *SafeConfig) ReloadConfig(confFile string) (err error) {
 	var c = &Config{
 		ActiveDirectoryAuthorityURL: "https://login.microsoftonline.com/",
 		ResourceManagerURL:          "https://management.azure.com/",
+		Delay:                       model.Duration(3 * time.Minute),
+		MaxConcurrentRequests:       4,
+		MetricsDataPlaneURL:         "https://{region}.metrics.monitor.azure.com/",
+		MetricsDataPlaneAudience:    "https://metrics.monitor.azure.com/",
 	}
 
 	yamlFile, err := ioutil.ReadFile(confFile)
@@ -56,9 +78,87 @@ func (sc *SafeConfig) ReloadConfig(confFile string) (err error) {
 	return nil
 }
 
-var validAggregations = []string{"Total", "Average", "Minimum", "Maximum"}
+var validAggregations = []string{"Total", "Average", "Minimum", "Maximum", "Count"}
+
+// Metric naming modes
+const (
+	// AzureMetricNaming names metrics after the Azure metric name, raw unit and aggregation
+	AzureMetricNaming = "azure"
+	// PrometheusMetricNaming names metrics following the Prometheus conventions, converting values to base units
+	PrometheusMetricNaming = "prometheus"
+)
+
+// Valid Prometheus metric and label names, checked both in the configuration and on the relabelled metrics
+var (
+	ValidMetricName = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+	ValidLabelName  = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+)
+
+// Types of credentials used to get access tokens. Without a type, credentials with a client ID and a secret or a
+// certificate use them, and other credentials use the first type of the default chain able to get a token:
+// environment, workload identity, managed identity, then Azure CLI.
+const (
+	ClientSecretCredentials      = "client_secret"
+	ClientCertificateCredentials = "client_certificate"
+	WorkloadIdentityCredentials  = "workload_identity"
+	ManagedIdentityCredentials   = "managed_identity"
+	AzureCLICredentials          = "azure_cli"
+	EnvironmentCredentials       = "environment"
+)
+
+// Backends collecting metric values
+const (
+	// ARMMetricsBackend queries the metrics of each resource through the Azure Resource Manager /batch API
+	ARMMetricsBackend = "arm"
+	// DataPlaneMetricsBackend queries the metrics of up to 50 resources of the same subscription, region and type
+	// at once through the regional Azure Monitor metrics:getBatch API
+	DataPlaneMetricsBackend = "data_plane"
+)
+
+// PrimaryAggregation selects the primary aggregation type of each metric, as given by its metric definition
+const PrimaryAggregation = "primary"
+
+// Time grains supported by the Azure Monitor metrics API
+var validIntervals = []model.Duration{
+	model.Duration(time.Minute),
+	model.Duration(5 * time.Minute),
+	model.Duration(15 * time.Minute),
+	model.Duration(30 * time.Minute),
+	model.Duration(time.Hour),
+	model.Duration(6 * time.Hour),
+	model.Duration(12 * time.Hour),
+	model.Duration(24 * time.Hour),
+}
 
 func (c *Config) Validate() (err error) {
+	if c.MetricNaming != "" && c.MetricNaming != AzureMetricNaming && c.MetricNaming != PrometheusMetricNaming {
+		return fmt.Errorf("metric_naming must be one of %s or %s", AzureMetricNaming, PrometheusMetricNaming)
+	}
+
+	if c.MetricNamespace != "" && !ValidMetricName.MatchString(c.MetricNamespace) {
+		return fmt.Errorf("metric_namespace %q is not a valid metric name prefix", c.MetricNamespace)
+	}
+
+	if err := c.validateQueryWindow(c.Interval, c.Timespan); err != nil {
+		return err
+	}
+
+	if err := c.validateCredentials(); err != nil {
+		return err
+	}
+
+	if err := c.validateAPIBudget(); err != nil {
+		return err
+	}
+
+	if c.MaxConcurrentRequests < 1 {
+		return fmt.Errorf("max_concurrent_requests must be at least 1")
+	}
+
+	if c.MetricsBackend != "" && c.MetricsBackend != ARMMetricsBackend && c.MetricsBackend != DataPlaneMetricsBackend {
+		return fmt.Errorf("metrics_backend must be one of %s or %s", ARMMetricsBackend, DataPlaneMetricsBackend)
+	}
+
 	for _, t := range c.Targets {
 		if err := c.validateAggregations(t.Aggregations); err != nil {
 			return err
@@ -75,6 +175,22 @@ func (c *Config) Validate() (err error) {
 		if len(t.Metrics) == 0 {
 			return fmt.Errorf("At least one metric needs to be specified in each resource")
 		}
+
+		if err := c.validateSubscriptions(t.Subscriptions, false); err != nil {
+			return err
+		}
+
+		if err := c.validateCollectionInterval(t.CollectionInterval); err != nil {
+			return err
+		}
+
+		if err := c.validateQueryWindow(t.Interval, t.Timespan); err != nil {
+			return err
+		}
+
+		if err := c.validateLabels(t.Labels, t.Metrics); err != nil {
+			return err
+		}
 	}
 
 	for _, t := range c.ResourceGroups {
@@ -93,6 +209,138 @@ func (c *Config) Validate() (err error) {
 		if len(t.Metrics) == 0 {
 			return fmt.Errorf("At least one metric needs to be specified in each resource group")
 		}
+
+		if err := c.validateSubscriptions(t.Subscriptions, t.AllSubscriptions); err != nil {
+			return err
+		}
+
+		if err := c.validateCollectionInterval(t.CollectionInterval); err != nil {
+			return err
+		}
+
+		if err := c.validateQueryWindow(t.Interval, t.Timespan); err != nil {
+			return err
+		}
+
+		if err := c.validateLabels(t.Labels, t.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateFilter(t.Filter); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range c.ResourceTags {
+		if err := c.validateSubscriptions(t.Subscriptions, t.AllSubscriptions); err != nil {
+			return err
+		}
+
+		if err := c.validateCollectionInterval(t.CollectionInterval); err != nil {
+			return err
+		}
+
+		if err := c.validateQueryWindow(t.Interval, t.Timespan); err != nil {
+			return err
+		}
+
+		if err := c.validateLabels(t.Labels, t.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateFilter(t.Filter); err != nil {
+			return err
+		}
+	}
+
+	for _, q := range c.ResourceQueries {
+		if err := c.validateAggregations(q.Aggregations); err != nil {
+			return err
+		}
+
+		if len(strings.TrimSpace(q.Query)) == 0 {
+			return fmt.Errorf("query needs to be specified in each resource query")
+		}
+
+		if len(q.Metrics) == 0 {
+			return fmt.Errorf("At least one metric needs to be specified in each resource query")
+		}
+
+		if err := c.validateSubscriptions(q.Subscriptions, q.AllSubscriptions); err != nil {
+			return err
+		}
+
+		if err := c.validateCollectionInterval(q.CollectionInterval); err != nil {
+			return err
+		}
+
+		if err := c.validateQueryWindow(q.Interval, q.Timespan); err != nil {
+			return err
+		}
+
+		if err := c.validateLabels(q.Labels, q.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateFilter(q.Filter); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range c.ResourceTypes {
+		if err := c.validateAggregations(t.Aggregations); err != nil {
+			return err
+		}
+
+		if len(t.ResourceTypes) == 0 {
+			return fmt.Errorf("At least one resource type needs to be specified in each resource types block")
+		}
+
+		if len(t.Metrics) == 0 {
+			return fmt.Errorf("At least one metric needs to be specified in each resource types block")
+		}
+
+		if err := c.validateSubscriptions(t.Subscriptions, t.AllSubscriptions); err != nil {
+			return err
+		}
+
+		if err := c.validateCollectionInterval(t.CollectionInterval); err != nil {
+			return err
+		}
+
+		if err := c.validateQueryWindow(t.Interval, t.Timespan); err != nil {
+			return err
+		}
+
+		if err := c.validateLabels(t.Labels, t.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateFilter(t.Filter); err != nil {
+			return err
+		}
+	}
+
+	for name, m := range c.Modules {
+		if err := c.validateAggregations(m.Aggregations); err != nil {
+			return err
+		}
+
+		if len(m.Metrics) == 0 {
+			return fmt.Errorf("At least one metric needs to be specified in module %s", name)
+		}
+
+		if err := c.validateQueryWindow(m.Interval, m.Timespan); err != nil {
+			return err
+		}
+
+		if err := c.validateLabels(m.Labels, m.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateFilter(m.Filter); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -100,6 +348,13 @@ func (c *Config) Validate() (err error) {
 
 func (c *Config) validateAggregations(aggregations []string) error {
 	for _, a := range aggregations {
+		if a == PrimaryAggregation {
+			if len(aggregations) > 1 {
+				return fmt.Errorf("%s aggregation cannot be combined with other aggregations", PrimaryAggregation)
+			}
+			continue
+		}
+
 		ok := false
 		for _, valid := range validAggregations {
 			if a == valid {
@@ -115,51 +370,356 @@ func (c *Config) validateAggregations(aggregations []string) error {
 	return nil
 }
 
+func (c *Config) validateSubscriptions(subscriptions []string, allSubscriptions bool) error {
+	if allSubscriptions && len(subscriptions) > 0 {
+		return fmt.Errorf("subscriptions and all_subscriptions are mutually exclusive")
+	}
+
+	if !allSubscriptions && len(subscriptions) == 0 && len(c.Credentials.SubscriptionID) == 0 {
+		return fmt.Errorf("subscription_id needs to be specified in credentials when subscriptions are not specified")
+	}
+
+	return nil
+}
+
+func (c *Config) validateCollectionInterval(interval model.Duration) error {
+	if interval != 0 && c.CollectionInterval == 0 {
+		return fmt.Errorf("collection_interval can only be set per block when the global collection_interval is set")
+	}
+
+	return nil
+}
+
+func (c *Config) validateQueryWindow(interval model.Duration, timespan model.Duration) error {
+	if interval != 0 {
+		ok := false
+		for _, valid := range validIntervals {
+			if interval == valid {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s is not one of the valid intervals (%v)", interval, validIntervals)
+		}
+	}
+
+	interval, timespan, _ = c.QueryWindow(interval, timespan, nil)
+	if timespan < interval {
+		return fmt.Errorf("timespan %s must be greater than or equal to interval %s", timespan, interval)
+	}
+
+	return nil
+}
+
+// validateCredentials checks the credentials type and the settings it requires
+func (c *Config) validateCredentials() error {
+	creds := c.Credentials
+	switch creds.Type {
+	case "", WorkloadIdentityCredentials, ManagedIdentityCredentials, AzureCLICredentials, EnvironmentCredentials:
+	case ClientSecretCredentials:
+		if creds.TenantID == "" || creds.ClientID == "" || creds.ClientSecret == "" {
+			return fmt.Errorf("%s credentials require tenant_id, client_id and client_secret", ClientSecretCredentials)
+		}
+	case ClientCertificateCredentials:
+		if creds.TenantID == "" || creds.ClientID == "" || creds.ClientCertificatePath == "" {
+			return fmt.Errorf("%s credentials require tenant_id, client_id and client_certificate_path", ClientCertificateCredentials)
+		}
+	default:
+		return fmt.Errorf("credentials type must be one of %s, %s, %s, %s, %s or %s", ClientSecretCredentials,
+			ClientCertificateCredentials, WorkloadIdentityCredentials, ManagedIdentityCredentials, AzureCLICredentials,
+			EnvironmentCredentials)
+	}
+	return nil
+}
+
+// validateLabels checks the static label names of a block and the renames and static labels of its metrics
+func (c *Config) validateLabels(labels map[string]string, metrics []Metric) error {
+	for name := range labels {
+		if !ValidLabelName.MatchString(name) {
+			return fmt.Errorf("%q is not a valid label name", name)
+		}
+	}
+
+	for _, m := range metrics {
+		if m.Rename != "" && !ValidMetricName.MatchString(m.Rename) {
+			return fmt.Errorf("rename %q of metric %s is not a valid metric name", m.Rename, m.Name)
+		}
+		for name := range m.Labels {
+			if !ValidLabelName.MatchString(name) {
+				return fmt.Errorf("%q is not a valid label name in metric %s", name, m.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateAPIBudget checks the rate and behaviour of the API budget
+func (c *Config) validateAPIBudget() error {
+	b := c.APIBudget
+	if b.RequestsPerHour < 0 || b.Burst < 0 || b.Reserve < 0 {
+		return fmt.Errorf("requests_per_hour, burst and reserve of api_budget must be positive")
+	}
+
+	switch b.OnExhausted {
+	case "", BudgetFail, BudgetSkipLowPriority, BudgetServeStale:
+	default:
+		return fmt.Errorf("on_exhausted must be one of %s, %s or %s", BudgetFail, BudgetSkipLowPriority, BudgetServeStale)
+	}
+
+	return nil
+}
+
+// validateFilter checks the tag filters of a discovery block
+func (c *Config) validateFilter(filter ResourceFilter) error {
+	if filter.TagsMatch != "" && filter.TagsMatch != TagsMatchAll && filter.TagsMatch != TagsMatchAny {
+		return fmt.Errorf("tags_match must be one of %s or %s", TagsMatchAll, TagsMatchAny)
+	}
+
+	for _, tag := range filter.Tags {
+		if len(tag.Name) == 0 {
+			return fmt.Errorf("name needs to be specified in each tag filter")
+		}
+		if len(tag.Value) > 0 && tag.ValueRe != nil {
+			return fmt.Errorf("value and value_re of tag filter %s are mutually exclusive", tag.Name)
+		}
+		if tag.Absent && (len(tag.Value) > 0 || tag.ValueRe != nil) {
+			return fmt.Errorf("absent tag filter %s cannot have a value", tag.Name)
+		}
+	}
+
+	return nil
+}
+
+// QueryWindow returns the interval, timespan and delay used to query metrics, given the settings of a block.
+// Settings not defined in the block fall back to the global ones. The timespan defaults to the interval,
+// or one minute if no interval is defined.
+func (c *Config) QueryWindow(interval model.Duration, timespan model.Duration, delay *model.Duration) (model.Duration, model.Duration, model.Duration) {
+	if interval == 0 {
+		interval = c.Interval
+	}
+	if timespan == 0 {
+		timespan = c.Timespan
+	}
+	if timespan == 0 {
+		timespan = interval
+	}
+	if timespan == 0 {
+		timespan = model.Duration(time.Minute)
+	}
+	// A block may set a delay of zero, only an unset delay falls back to the global one
+	if delay == nil {
+		delay = &c.Delay
+	}
+	return interval, timespan, *delay
+}
+
+// Behaviours when the API budget is exhausted
+const (
+	BudgetFail            = "fail"
+	BudgetSkipLowPriority = "skip_low_priority"
+	BudgetServeStale      = "serve_stale"
+)
+
+// APIBudget limits the rate of requests made to Azure with a token bucket
+type APIBudget struct {
+	RequestsPerHour int    `yaml:"requests_per_hour"`
+	Burst           int    `yaml:"burst"`
+	Reserve         int    `yaml:"reserve"`
+	OnExhausted     string `yaml:"on_exhausted"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
 // Credentials - Azure credentials
 type Credentials struct {
-	SubscriptionID string `yaml:"subscription_id"`
-	ClientID       string `yaml:"client_id"`
-	ClientSecret   string `yaml:"client_secret"`
-	TenantID       string `yaml:"tenant_id"`
+	Type                      string `yaml:"type"`
+	SubscriptionID            string `yaml:"subscription_id"`
+	ClientID                  string `yaml:"client_id"`
+	ClientSecret              string `yaml:"client_secret"`
+	ClientCertificatePath     string `yaml:"client_certificate_path"`
+	ClientCertificatePassword string `yaml:"client_certificate_password"`
+	FederatedTokenFile        string `yaml:"federated_token_file"`
+	TenantID                  string `yaml:"tenant_id"`
 
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // Target represents Azure target resource and its associated metric definitions
 type Target struct {
-	Resource     string   `yaml:"resource"`
-	Metrics      []Metric `yaml:"metrics"`
-	Aggregations []string `yaml:"aggregations"`
+	Resource             string            `yaml:"resource"`
+	Subscriptions        []string          `yaml:"subscriptions"`
+	Metrics              []Metric          `yaml:"metrics"`
+	Aggregations         []string          `yaml:"aggregations"`
+	Interval             model.Duration    `yaml:"interval"`
+	Timespan             model.Duration    `yaml:"timespan"`
+	Delay                *model.Duration   `yaml:"delay"`
+	Labels               map[string]string `yaml:"labels"`
+	MetricRelabelConfigs []RelabelConfig   `yaml:"metric_relabel_configs"`
+	CollectionInterval   model.Duration    `yaml:"collection_interval"`
+	Priority             int               `yaml:"priority"`
 
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // ResourceGroup represents Azure target resource group and its associated metric definitions
 type ResourceGroup struct {
-	ResourceGroup         string   `yaml:"resource_group"`
-	ResourceTypes         []string `yaml:"resource_types"`
-	ResourceNameIncludeRe []Regexp `yaml:"resource_name_include_re"`
-	ResourceNameExcludeRe []Regexp `yaml:"resource_name_exclude_re"`
-	Metrics               []Metric `yaml:"metrics"`
-	Aggregations          []string `yaml:"aggregations"`
+	ResourceGroup         string            `yaml:"resource_group"`
+	Subscriptions         []string          `yaml:"subscriptions"`
+	AllSubscriptions      bool              `yaml:"all_subscriptions"`
+	ResourceTypes         []string          `yaml:"resource_types"`
+	ResourceNameIncludeRe []Regexp          `yaml:"resource_name_include_re"`
+	ResourceNameExcludeRe []Regexp          `yaml:"resource_name_exclude_re"`
+	Filter                ResourceFilter    `yaml:"filter"`
+	Metrics               []Metric          `yaml:"metrics"`
+	Aggregations          []string          `yaml:"aggregations"`
+	Interval              model.Duration    `yaml:"interval"`
+	Timespan              model.Duration    `yaml:"timespan"`
+	Delay                 *model.Duration   `yaml:"delay"`
+	Labels                map[string]string `yaml:"labels"`
+	MetricRelabelConfigs  []RelabelConfig   `yaml:"metric_relabel_configs"`
+	CollectionInterval    model.Duration    `yaml:"collection_interval"`
+	Priority              int               `yaml:"priority"`
 
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
 // ResourceTag selects resources with tag name and tag value
 type ResourceTag struct {
-	ResourceTagName  string   `yaml:"resource_tag_name"`
-	ResourceTagValue string   `yaml:"resource_tag_value"`
-	ResourceTypes    []string `yaml:"resource_types"`
-	Metrics          []Metric `yaml:"metrics"`
-	Aggregations     []string `yaml:"aggregations"`
+	ResourceTagName      string            `yaml:"resource_tag_name"`
+	ResourceTagValue     string            `yaml:"resource_tag_value"`
+	Subscriptions        []string          `yaml:"subscriptions"`
+	AllSubscriptions     bool              `yaml:"all_subscriptions"`
+	ResourceTypes        []string          `yaml:"resource_types"`
+	Filter               ResourceFilter    `yaml:"filter"`
+	Metrics              []Metric          `yaml:"metrics"`
+	Aggregations         []string          `yaml:"aggregations"`
+	Interval             model.Duration    `yaml:"interval"`
+	Timespan             model.Duration    `yaml:"timespan"`
+	Delay                *model.Duration   `yaml:"delay"`
+	Labels               map[string]string `yaml:"labels"`
+	MetricRelabelConfigs []RelabelConfig   `yaml:"metric_relabel_configs"`
+	CollectionInterval   model.Duration    `yaml:"collection_interval"`
+	Priority             int               `yaml:"priority"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// ResourceQuery selects resources with an Azure Resource Graph query
+type ResourceQuery struct {
+	Query                string            `yaml:"query"`
+	Subscriptions        []string          `yaml:"subscriptions"`
+	AllSubscriptions     bool              `yaml:"all_subscriptions"`
+	Filter               ResourceFilter    `yaml:"filter"`
+	Metrics              []Metric          `yaml:"metrics"`
+	Aggregations         []string          `yaml:"aggregations"`
+	Interval             model.Duration    `yaml:"interval"`
+	Timespan             model.Duration    `yaml:"timespan"`
+	Delay                *model.Duration   `yaml:"delay"`
+	Labels               map[string]string `yaml:"labels"`
+	MetricRelabelConfigs []RelabelConfig   `yaml:"metric_relabel_configs"`
+	CollectionInterval   model.Duration    `yaml:"collection_interval"`
+	Priority             int               `yaml:"priority"`
 
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
-// Metric defines metric name
+// ResourceType selects the resources of the given types across whole subscriptions
+type ResourceType struct {
+	ResourceTypes         []string          `yaml:"resource_types"`
+	Subscriptions         []string          `yaml:"subscriptions"`
+	AllSubscriptions      bool              `yaml:"all_subscriptions"`
+	ResourceNameIncludeRe []Regexp          `yaml:"resource_name_include_re"`
+	ResourceNameExcludeRe []Regexp          `yaml:"resource_name_exclude_re"`
+	Filter                ResourceFilter    `yaml:"filter"`
+	Metrics               []Metric          `yaml:"metrics"`
+	Aggregations          []string          `yaml:"aggregations"`
+	Interval              model.Duration    `yaml:"interval"`
+	Timespan              model.Duration    `yaml:"timespan"`
+	Delay                 *model.Duration   `yaml:"delay"`
+	Labels                map[string]string `yaml:"labels"`
+	MetricRelabelConfigs  []RelabelConfig   `yaml:"metric_relabel_configs"`
+	CollectionInterval    model.Duration    `yaml:"collection_interval"`
+	Priority              int               `yaml:"priority"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// Tag filter matching modes
+const (
+	TagsMatchAll = "all"
+	TagsMatchAny = "any"
+)
+
+// ResourceFilter selects discovered resources by tags, location, resource group and resource type
+type ResourceFilter struct {
+	Tags            []TagFilter `yaml:"tags"`
+	TagsMatch       string      `yaml:"tags_match"`
+	LocationInclude []string    `yaml:"location_include"`
+	LocationExclude []string    `yaml:"location_exclude"`
+	ResourceGroupRe []Regexp    `yaml:"resource_group_re"`
+	ResourceTypeRe  []Regexp    `yaml:"resource_type_re"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// TagFilter matches a resource tag. Without value, value_re or absent, the tag only needs to be present.
+type TagFilter struct {
+	Name    string  `yaml:"name"`
+	Value   string  `yaml:"value"`
+	ValueRe *Regexp `yaml:"value_re"`
+	Absent  bool    `yaml:"absent"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// Module defines the metrics collected for the targets probed through the /probe endpoint
+type Module struct {
+	ResourceTypes         []string          `yaml:"resource_types"`
+	ResourceNameIncludeRe []Regexp          `yaml:"resource_name_include_re"`
+	ResourceNameExcludeRe []Regexp          `yaml:"resource_name_exclude_re"`
+	Filter                ResourceFilter    `yaml:"filter"`
+	Metrics               []Metric          `yaml:"metrics"`
+	Aggregations          []string          `yaml:"aggregations"`
+	Interval              model.Duration    `yaml:"interval"`
+	Timespan              model.Duration    `yaml:"timespan"`
+	Delay                 *model.Duration   `yaml:"delay"`
+	Labels                map[string]string `yaml:"labels"`
+	MetricRelabelConfigs  []RelabelConfig   `yaml:"metric_relabel_configs"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// Metric defines metric name and the dimensions it is split by
 type Metric struct {
-	Name string `yaml:"name"`
+	Name                 string            `yaml:"name"`
+	Dimensions           []string          `yaml:"dimensions"`
+	Rename               string            `yaml:"rename"`
+	Labels               map[string]string `yaml:"labels"`
+	MetricRelabelConfigs []RelabelConfig   `yaml:"metric_relabel_configs"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// Relabel actions
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+)
+
+// RelabelConfig is a Prometheus-style relabeling rule applied to exported series
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow"`
+	Separator    string   `yaml:"separator"`
+	Regex        Regexp   `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
 
 	XXX map[string]interface{} `yaml:",inline"`
 }
@@ -192,6 +752,18 @@ func (s *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *APIBudget) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain APIBudget
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (s *Credentials) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain Credentials
@@ -240,6 +812,98 @@ func (s *ResourceGroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ResourceQuery) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ResourceQuery
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ResourceType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ResourceType
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ResourceFilter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ResourceFilter
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *TagFilter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TagFilter
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *Module) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Module
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*s = RelabelConfig{
+		Separator:   ";",
+		Regex:       Regexp{regexp.MustCompile("^(?:(.*))$")},
+		Replacement: "$1",
+		Action:      RelabelReplace,
+	}
+	type plain RelabelConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+
+	switch s.Action {
+	case RelabelReplace:
+		if s.TargetLabel == "" {
+			return fmt.Errorf("relabel configuration for %s action requires target_label", s.Action)
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(s.SourceLabels) == 0 {
+			return fmt.Errorf("relabel configuration for %s action requires source_labels", s.Action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+	default:
+		return fmt.Errorf("unknown relabel action %q", s.Action)
+	}
+	return nil
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
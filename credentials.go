@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+var (
+	imdsTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureCLICommand   = "az"
+
+	// Timeout of managed identity requests in the default chain, where the endpoint may not exist
+	imdsProbeTimeout = 5 * time.Second
+)
+
+// accessToken is a bearer token and its expiry.
+type accessToken struct {
+	token     string
+	expiresOn time.Time
+}
+
+// credentialProvider gets access tokens for Azure resources, such as https://management.azure.com/.
+type credentialProvider interface {
+	getToken(resource string) (accessToken, error)
+}
+
+// newCredentialProvider returns the provider of the configured credentials type, or the default chain without one.
+func newCredentialProvider(c config.Credentials, client *http.Client) (credentialProvider, error) {
+	authority := sc.C.ActiveDirectoryAuthorityURL
+	switch c.Type {
+	case config.ClientSecretCredentials:
+		return &clientSecretCredential{client: client, authority: authority, tenantID: c.TenantID, clientID: c.ClientID, secret: c.ClientSecret}, nil
+	case config.ClientCertificateCredentials:
+		return newClientCertificateCredential(client, authority, c.TenantID, c.ClientID, c.ClientCertificatePath, c.ClientCertificatePassword)
+	case config.WorkloadIdentityCredentials:
+		return newWorkloadIdentityCredential(client, authority, c)
+	case config.ManagedIdentityCredentials:
+		return &managedIdentityCredential{client: client, clientID: c.ClientID}, nil
+	case config.AzureCLICredentials:
+		return &azureCLICredential{}, nil
+	case config.EnvironmentCredentials:
+		return newEnvironmentCredential(client, authority)
+	}
+
+	// Without a type, configured client credentials keep being used as before
+	if c.ClientID != "" && c.ClientSecret != "" {
+		return &clientSecretCredential{client: client, authority: authority, tenantID: c.TenantID, clientID: c.ClientID, secret: c.ClientSecret}, nil
+	}
+	if c.ClientID != "" && c.ClientCertificatePath != "" {
+		return newClientCertificateCredential(client, authority, c.TenantID, c.ClientID, c.ClientCertificatePath, c.ClientCertificatePassword)
+	}
+	return newDefaultCredentialChain(client, authority, c), nil
+}
+
+// Returns the token endpoint of a tenant, version 2 taking scopes instead of resources
+func tokenEndpoint(authority string, tenantID string, v2 bool) string {
+	endpoint := fmt.Sprintf("%s/%s/oauth2/token", strings.TrimSuffix(authority, "/"), tenantID)
+	if v2 {
+		endpoint = fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(authority, "/"), tenantID)
+	}
+	return endpoint
+}
+
+// Requests a token from a token endpoint with the given form
+func requestToken(client *http.Client, endpoint string, form url.Values) (accessToken, error) {
+	resp, err := client.PostForm(endpoint, form)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("Error authenticating against Azure API: %v", err)
+	}
+	return readTokenResponse(resp)
+}
+
+// Reads a token from the response of a token endpoint
+func readTokenResponse(resp *http.Response) (accessToken, error) {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("Error reading body of response: %v", err)
+	}
+	if resp.StatusCode != 200 {
+		return accessToken{}, fmt.Errorf("Did not get status code 200, got: %d with body: %s", resp.StatusCode, string(body))
+	}
+	return parseTokenResponse(body)
+}
+
+// Parses a token response, whose expiry is given either as a Unix time or in seconds from now,
+// as a number or a string
+func parseTokenResponse(body []byte) (accessToken, error) {
+	var data struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresOn   interface{} `json:"expires_on"`
+		ExpiresIn   interface{} `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return accessToken{}, fmt.Errorf("Error unmarshalling response body: %v", err)
+	}
+	if data.AccessToken == "" {
+		return accessToken{}, fmt.Errorf("No access token in response")
+	}
+
+	if expiresOn, ok := parseTokenTime(data.ExpiresOn); ok {
+		return accessToken{token: data.AccessToken, expiresOn: time.Unix(expiresOn, 0).UTC()}, nil
+	}
+	if expiresIn, ok := parseTokenTime(data.ExpiresIn); ok {
+		return accessToken{token: data.AccessToken, expiresOn: time.Now().Add(time.Duration(expiresIn) * time.Second).UTC()}, nil
+	}
+	return accessToken{}, fmt.Errorf("No valid expires_on or expires_in in response")
+}
+
+// Returns the integer value of a token time given as a number or a string
+func parseTokenTime(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return int64(v), true
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// clientSecretCredential gets tokens for an application with a client secret.
+type clientSecretCredential struct {
+	client    *http.Client
+	authority string
+	tenantID  string
+	clientID  string
+	secret    string
+}
+
+func (c *clientSecretCredential) getToken(resource string) (accessToken, error) {
+	return requestToken(c.client, tokenEndpoint(c.authority, c.tenantID, false), url.Values{
+		"grant_type":    {"client_credentials"},
+		"resource":      {resource},
+		"client_id":     {c.clientID},
+		"client_secret": {c.secret},
+	})
+}
+
+// clientCertificateCredential gets tokens for an application with an assertion signed by its certificate.
+type clientCertificateCredential struct {
+	client     *http.Client
+	authority  string
+	tenantID   string
+	clientID   string
+	key        *rsa.PrivateKey
+	thumbprint string
+}
+
+// newClientCertificateCredential reads the certificate and RSA private key of an application from a PEM file,
+// or from a PKCS#12 file protected by the given password.
+func newClientCertificateCredential(client *http.Client, authority string, tenantID string, clientID string, path string, password string) (*clientCertificateCredential, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading client certificate: %v", err)
+	}
+
+	var blocks []*pem.Block
+	lower := strings.ToLower(path)
+	if strings.HasSuffix(lower, ".pfx") || strings.HasSuffix(lower, ".p12") {
+		blocks, err = pkcs12.ToPEM(data, password)
+		if err != nil {
+			return nil, fmt.Errorf("Error decoding PKCS#12 client certificate: %v", err)
+		}
+		for _, block := range blocks {
+			// RSA keys of PKCS#12 files are converted to PKCS#1
+			if block.Type == "PRIVATE KEY" {
+				block.Type = "RSA PRIVATE KEY"
+			}
+		}
+	} else {
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			blocks = append(blocks, block)
+		}
+	}
+
+	c := &clientCertificateCredential{client: client, authority: authority, tenantID: tenantID, clientID: clientID}
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			if c.thumbprint != "" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing client certificate: %v", err)
+			}
+			thumbprint := sha1.Sum(cert.Raw)
+			c.thumbprint = base64.RawURLEncoding.EncodeToString(thumbprint[:])
+		case "RSA PRIVATE KEY":
+			c.key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing client certificate key: %v", err)
+			}
+		case "PRIVATE KEY":
+			key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("Error parsing client certificate key: %v", err)
+			}
+			rsaKey, ok := key.(*rsa.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("Client certificate key must be an RSA key")
+			}
+			c.key = rsaKey
+		}
+	}
+	if c.thumbprint == "" || c.key == nil {
+		return nil, fmt.Errorf("Client certificate %s must contain a certificate and its unencrypted private key", path)
+	}
+	return c, nil
+}
+
+func (c *clientCertificateCredential) getToken(resource string) (accessToken, error) {
+	endpoint := tokenEndpoint(c.authority, c.tenantID, false)
+	assertion, err := c.assertion(endpoint)
+	if err != nil {
+		return accessToken{}, err
+	}
+	return requestToken(c.client, endpoint, url.Values{
+		"grant_type":            {"client_credentials"},
+		"resource":              {resource},
+		"client_id":             {c.clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	})
+}
+
+// Returns a JWT for the token endpoint signed with the key of the certificate
+func (c *clientCertificateCredential) assertion(audience string) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "x5t": c.thumbprint})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": c.clientID,
+		"sub": c.clientID,
+		"jti": hex.EncodeToString(id),
+		"nbf": now.Unix(),
+		"exp": now.Add(10 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	hashed := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, c.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", fmt.Errorf("Error signing client assertion: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// workloadIdentityCredential gets tokens for an application trusting a federated token, such as the service account
+// token projected by Azure workload identity on AKS.
+type workloadIdentityCredential struct {
+	client    *http.Client
+	authority string
+	tenantID  string
+	clientID  string
+	tokenFile string
+}
+
+// newWorkloadIdentityCredential uses the configured settings, falling back to the AZURE_* environment variables
+// set by the workload identity webhook.
+func newWorkloadIdentityCredential(client *http.Client, authority string, c config.Credentials) (*workloadIdentityCredential, error) {
+	w := &workloadIdentityCredential{
+		client:    client,
+		authority: authority,
+		tenantID:  firstNonEmpty(c.TenantID, os.Getenv("AZURE_TENANT_ID")),
+		clientID:  firstNonEmpty(c.ClientID, os.Getenv("AZURE_CLIENT_ID")),
+		tokenFile: firstNonEmpty(c.FederatedTokenFile, os.Getenv("AZURE_FEDERATED_TOKEN_FILE")),
+	}
+	if host := os.Getenv("AZURE_AUTHORITY_HOST"); host != "" {
+		w.authority = host
+	}
+	if w.tenantID == "" || w.clientID == "" || w.tokenFile == "" {
+		return nil, fmt.Errorf("Workload identity requires a tenant ID, a client ID and a federated token file")
+	}
+	return w, nil
+}
+
+func (w *workloadIdentityCredential) getToken(resource string) (accessToken, error) {
+	// The federated token is rotated, it is read again for each token
+	assertion, err := ioutil.ReadFile(w.tokenFile)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("Error reading federated token: %v", err)
+	}
+	return requestToken(w.client, tokenEndpoint(w.authority, w.tenantID, true), url.Values{
+		"grant_type":            {"client_credentials"},
+		"scope":                 {strings.TrimSuffix(resource, "/") + "/.default"},
+		"client_id":             {w.clientID},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {strings.TrimSpace(string(assertion))},
+	})
+}
+
+// managedIdentityCredential gets tokens for the managed identity of the machine from the instance metadata service,
+// a user-assigned identity being selected by its client ID.
+type managedIdentityCredential struct {
+	client   *http.Client
+	clientID string
+}
+
+func (m *managedIdentityCredential) getToken(resource string) (accessToken, error) {
+	values := url.Values{"resource": {resource}, "api-version": {"2018-02-01"}}
+	if m.clientID != "" {
+		values.Set("client_id", m.clientID)
+	}
+	req, err := http.NewRequest("GET", imdsTokenEndpoint+"?"+values.Encode(), nil)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("Error getting token against Azure MSI endpoint: %v", err)
+	}
+	req.Header.Add("Metadata", "true")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("Error authenticating against Azure API: %v", err)
+	}
+	return readTokenResponse(resp)
+}
+
+// azureCLICredential gets tokens from the Azure CLI, using the token cache of the logged in user.
+type azureCLICredential struct{}
+
+func (a *azureCLICredential) getToken(resource string) (accessToken, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(azureCLICommand, "account", "get-access-token", "--resource", resource, "--output", "json")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return accessToken{}, fmt.Errorf("Error getting token from Azure CLI: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseCLIToken(stdout.Bytes())
+}
+
+// Parses the output of az account get-access-token. Older versions only give the expiry as a local time.
+func parseCLIToken(output []byte) (accessToken, error) {
+	var data struct {
+		AccessToken string      `json:"accessToken"`
+		ExpiresOn   string      `json:"expiresOn"`
+		UnixExpires interface{} `json:"expires_on"`
+	}
+	if err := json.Unmarshal(output, &data); err != nil {
+		return accessToken{}, fmt.Errorf("Error unmarshalling Azure CLI token: %v", err)
+	}
+	if data.AccessToken == "" {
+		return accessToken{}, fmt.Errorf("No access token in Azure CLI output")
+	}
+
+	if expiresOn, ok := parseTokenTime(data.UnixExpires); ok {
+		return accessToken{token: data.AccessToken, expiresOn: time.Unix(expiresOn, 0).UTC()}, nil
+	}
+	expiresOn, err := time.ParseInLocation("2006-01-02 15:04:05.999999", data.ExpiresOn, time.Local)
+	if err != nil {
+		return accessToken{}, fmt.Errorf("Error parsing expiry of Azure CLI token: %v", err)
+	}
+	return accessToken{token: data.AccessToken, expiresOn: expiresOn.UTC()}, nil
+}
+
+// newEnvironmentCredential returns the client secret or certificate credentials given by the AZURE_TENANT_ID,
+// AZURE_CLIENT_ID and AZURE_CLIENT_SECRET or AZURE_CLIENT_CERTIFICATE_PATH environment variables, the password of
+// a PKCS#12 certificate being given by AZURE_CLIENT_CERTIFICATE_PASSWORD.
+func newEnvironmentCredential(client *http.Client, authority string) (credentialProvider, error) {
+	tenantID, clientID := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+	if host := os.Getenv("AZURE_AUTHORITY_HOST"); host != "" {
+		authority = host
+	}
+	if tenantID == "" || clientID == "" {
+		return nil, fmt.Errorf("AZURE_TENANT_ID and AZURE_CLIENT_ID must be set")
+	}
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		return &clientSecretCredential{client: client, authority: authority, tenantID: tenantID, clientID: clientID, secret: secret}, nil
+	}
+	if path := os.Getenv("AZURE_CLIENT_CERTIFICATE_PATH"); path != "" {
+		return newClientCertificateCredential(client, authority, tenantID, clientID, path, os.Getenv("AZURE_CLIENT_CERTIFICATE_PASSWORD"))
+	}
+	return nil, fmt.Errorf("AZURE_CLIENT_SECRET or AZURE_CLIENT_CERTIFICATE_PATH must be set")
+}
+
+// chainedCredential tries credentials in order until one gets a token, then keeps using that one.
+type chainedCredential struct {
+	mtx         sync.Mutex
+	credentials []namedCredential
+	selected    credentialProvider
+}
+
+type namedCredential struct {
+	name       string
+	credential credentialProvider
+	// Set when the credential is not available, e.g. for lack of environment variables
+	err error
+}
+
+// newDefaultCredentialChain returns the chain of environment, workload identity, managed identity and Azure CLI
+// credentials.
+func newDefaultCredentialChain(client *http.Client, authority string, c config.Credentials) *chainedCredential {
+	chain := &chainedCredential{}
+
+	env, err := newEnvironmentCredential(client, authority)
+	chain.credentials = append(chain.credentials, namedCredential{config.EnvironmentCredentials, env, err})
+
+	workload, err := newWorkloadIdentityCredential(client, authority, c)
+	chain.credentials = append(chain.credentials, namedCredential{config.WorkloadIdentityCredentials, workload, err})
+
+	imdsClient := &http.Client{Transport: client.Transport, Timeout: imdsProbeTimeout}
+	chain.credentials = append(chain.credentials, namedCredential{config.ManagedIdentityCredentials,
+		&managedIdentityCredential{client: imdsClient, clientID: c.ClientID}, nil})
+
+	chain.credentials = append(chain.credentials, namedCredential{config.AzureCLICredentials, &azureCLICredential{}, nil})
+	return chain
+}
+
+func (c *chainedCredential) getToken(resource string) (accessToken, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.selected != nil {
+		return c.selected.getToken(resource)
+	}
+
+	var errs []string
+	for _, nc := range c.credentials {
+		if nc.err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", nc.name, nc.err))
+			continue
+		}
+		token, err := nc.credential.getToken(resource)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", nc.name, err))
+			continue
+		}
+		log.Printf("Using %s credentials", nc.name)
+		c.selected = nc.credential
+		return token, nil
+	}
+	return accessToken{}, fmt.Errorf("No credentials of the default chain could get a token: %s", strings.Join(errs, "; "))
+}
+
+// Returns the first non-empty value
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+)
+
+func TestParseTokenResponse(t *testing.T) {
+	expiry := time.Unix(1600000000, 0).UTC()
+	var cases = []struct {
+		body string
+		want time.Time
+	}{
+		{`{"access_token": "token", "expires_on": "1600000000"}`, expiry},
+		{`{"access_token": "token", "expires_on": 1600000000}`, expiry},
+		{`{"access_token": "token", "expires_in": 3600}`, time.Now().Add(time.Hour).UTC()},
+		{`{"access_token": "token", "expires_in": "3600"}`, time.Now().Add(time.Hour).UTC()},
+	}
+
+	for _, c := range cases {
+		got, err := parseTokenResponse([]byte(c.body))
+		if err != nil {
+			t.Errorf("doesn't parse token response %s: %v", c.body, err)
+			continue
+		}
+		if got.token != "token" || got.expiresOn.Sub(c.want) > time.Minute || c.want.Sub(got.expiresOn) > time.Minute {
+			t.Errorf("doesn't parse token response %s\ngot: %v\nwant: %v", c.body, got, c.want)
+		}
+	}
+
+	if _, err := parseTokenResponse([]byte(`{"access_token": "token"}`)); err == nil {
+		t.Errorf("doesn't fail without expiry")
+	}
+}
+
+func TestParseCLIToken(t *testing.T) {
+	got, err := parseCLIToken([]byte(`{"accessToken": "token", "expiresOn": "2020-09-13 12:26:40.000000", "expires_on": 1600000000}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Unix(1600000000, 0).UTC(); got.token != "token" || !got.expiresOn.Equal(want) {
+		t.Errorf("doesn't parse Azure CLI token\ngot: %v\nwant: %v", got, want)
+	}
+
+	got, err = parseCLIToken([]byte(`{"accessToken": "token", "expiresOn": "2020-09-13 12:26:40.000000"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 9, 13, 12, 26, 40, 0, time.Local); !got.expiresOn.Equal(want) {
+		t.Errorf("doesn't parse local expiry of older Azure CLI versions\ngot: %v\nwant: %v", got.expiresOn, want)
+	}
+}
+
+// Writes a self-signed certificate and its key to a PEM file, returning its path and certificate
+func writeClientCertificate(t *testing.T, dir string) (string, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "exporter"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...)
+	path := filepath.Join(dir, "client.pem")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path, cert
+}
+
+func TestClientCertificateCredential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path, cert := writeClientCertificate(t, dir)
+
+	var endpoint string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tenant/oauth2/token" || r.FormValue("client_id") != "app" || r.FormValue("resource") != "https://management.azure.com/" {
+			t.Errorf("doesn't request a token for the application\ngot: %s %v", r.URL.Path, r.Form)
+		}
+
+		parts := strings.Split(r.FormValue("client_assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("doesn't send a JWT assertion\ngot: %s", r.FormValue("client_assertion"))
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		hashed := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, hashed[:], signature); err != nil {
+			t.Errorf("doesn't sign the assertion with the certificate key: %v", err)
+		}
+		var claims map[string]interface{}
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(payload, &claims)
+		if claims["aud"] != endpoint || claims["iss"] != "app" || claims["sub"] != "app" {
+			t.Errorf("doesn't set the assertion claims\ngot: %v", claims)
+		}
+
+		fmt.Fprint(w, `{"access_token": "token", "expires_on": "1600000000"}`)
+	}))
+	defer server.Close()
+	endpoint = server.URL + "/tenant/oauth2/token"
+
+	credential, err := newClientCertificateCredential(server.Client(), server.URL+"/", "tenant", "app", path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := credential.getToken("https://management.azure.com/")
+	if err != nil || token.token != "token" {
+		t.Errorf("doesn't get a token\ngot: %v, %v", token, err)
+	}
+}
+
+func TestClientCertificateCredentialPKCS12(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/client.crt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := newClientCertificateCredential(http.DefaultClient, "", "tenant", "app", "testdata/client.pfx", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbprint := sha1.Sum(cert.Raw)
+	if want := base64.RawURLEncoding.EncodeToString(thumbprint[:]); credential.thumbprint != want {
+		t.Errorf("doesn't read the certificate of the PKCS#12 file\ngot: %v\nwant: %v", credential.thumbprint, want)
+	}
+	if publicKey := cert.PublicKey.(*rsa.PublicKey); credential.key.N.Cmp(publicKey.N) != 0 {
+		t.Errorf("doesn't read the private key of the certificate from the PKCS#12 file")
+	}
+
+	if _, err := newClientCertificateCredential(http.DefaultClient, "", "tenant", "app", "testdata/client.pfx", "wrong"); err == nil {
+		t.Errorf("doesn't fail with the wrong password")
+	}
+}
+
+func TestWorkloadIdentityCredential(t *testing.T) {
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("federated\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tenant/oauth2/v2.0/token" || r.FormValue("client_assertion") != "federated" ||
+			r.FormValue("scope") != "https://management.azure.com/.default" || r.FormValue("client_id") != "app" {
+			t.Errorf("doesn't exchange the federated token\ngot: %s %v", r.URL.Path, r.Form)
+		}
+		fmt.Fprint(w, `{"access_token": "token", "expires_in": 3600}`)
+	}))
+	defer server.Close()
+
+	credential, err := newWorkloadIdentityCredential(server.Client(), server.URL, config.Credentials{
+		TenantID:           "tenant",
+		ClientID:           "app",
+		FederatedTokenFile: tokenFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := credential.getToken("https://management.azure.com/")
+	if err != nil || token.token != "token" {
+		t.Errorf("doesn't get a token\ngot: %v, %v", token, err)
+	}
+}
+
+func TestDefaultCredentialChain(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("client_id") != "identity" {
+			t.Errorf("doesn't request a token for the user-assigned managed identity\ngot: %v", r.URL.Query())
+		}
+		fmt.Fprint(w, `{"access_token": "token", "expires_on": "1600000000"}`)
+	}))
+	defer server.Close()
+
+	previous := imdsTokenEndpoint
+	imdsTokenEndpoint = server.URL
+	defer func() { imdsTokenEndpoint = previous }()
+	for _, name := range []string{"AZURE_TENANT_ID", "AZURE_CLIENT_ID", "AZURE_FEDERATED_TOKEN_FILE"} {
+		defer os.Setenv(name, os.Getenv(name))
+		os.Unsetenv(name)
+	}
+
+	// Without environment variables, the managed identity is the first available credential
+	chain := newDefaultCredentialChain(server.Client(), server.URL, config.Credentials{ClientID: "identity"})
+	token, err := chain.getToken("https://management.azure.com/")
+	if err != nil || token.token != "token" {
+		t.Errorf("doesn't get a token from the managed identity\ngot: %v, %v", token, err)
+	}
+	if _, ok := chain.selected.(*managedIdentityCredential); !ok {
+		t.Errorf("doesn't keep using the credential which got a token\ngot: %T", chain.selected)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Maximum number of resources the metrics:getBatch API accepts in a request
+var dataPlaneBatchSize = 50
+
+// AzureMetricsBatchResponse represents the metric values of several resources returned by the metrics:getBatch API.
+type AzureMetricsBatchResponse struct {
+	Values []struct {
+		ResourceID string `json:"resourceid"`
+		AzureMetricValueResponse
+	} `json:"values"`
+}
+
+type metricsBatchRequest struct {
+	ResourceIDs []string `json:"resourceids"`
+}
+
+// dataPlaneCollectMetrics collects the metrics of resources through the metrics:getBatch API, querying together the
+// resources of the same subscription, region and type which share the same query. Resources of unknown region are
+// collected through the Azure Resource Manager /batch API instead.
+func (c *Collector) dataPlaneCollectMetrics(ch chan<- prometheus.Metric, resources []resourceMeta, status *scrapeStatus) {
+	publishedResources := &publishedSet{keys: map[string]bool{}}
+
+	var groups [][]resourceMeta
+	var unlocated []resourceMeta
+	index := make(map[string]int)
+	for _, rm := range resources {
+		if rm.resource.Location == "" {
+			unlocated = append(unlocated, rm)
+			continue
+		}
+		key := dataPlaneGroupKey(rm)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], rm)
+	}
+
+	var batches [][]resourceMeta
+	for _, group := range groups {
+		for _, r := range batchRanges(len(group), dataPlaneBatchSize) {
+			batches = append(batches, group[r[0]:r[1]])
+		}
+	}
+
+	forEachConcurrently(len(batches), func(b int) {
+		batch := batches[b]
+		body, err := ac.getMetricsBatchResponseBody(batch)
+		if err != nil {
+			log.Printf("Failed to get metrics of %d resources: %v", len(batch), err)
+			status.failResources(batch, reasonBatch, err)
+			return
+		}
+
+		var batchData AzureMetricsBatchResponse
+		err = json.Unmarshal(body, &batchData)
+		if err != nil {
+			log.Printf("Failed to unmarshal metrics of %d resources: %v", len(batch), err)
+			status.failResources(batch, reasonBatch, err)
+			return
+		}
+
+		// Values are matched to the resources by ID, as their order is not guaranteed
+		values := make(map[string]AzureMetricValueResponse)
+		for _, value := range batchData.Values {
+			values[strings.ToLower(value.ResourceID)] = value.AzureMetricValueResponse
+		}
+		for _, rm := range batch {
+			value, ok := values[strings.ToLower(queriedResourceID(rm))]
+			if !ok {
+				batchItemFailed(status, rm, reasonBatch, 0, "no metrics returned")
+				continue
+			}
+			c.extractMetrics(ch, rm, value, publishedResources)
+		}
+	})
+
+	// All the requests of a resource share its region, so no resource is collected by both backends
+	if len(unlocated) > 0 {
+		c.batchCollectMetrics(ch, unlocated, status)
+	}
+}
+
+// Returns the key of the resources which can be queried together through the metrics:getBatch API
+func dataPlaneGroupKey(rm resourceMeta) string {
+	return strings.Join([]string{
+		rm.subscription,
+		strings.ToLower(rm.resource.Location),
+		strings.ToLower(GetResourceType(rm.resourceURL)),
+		rm.metrics,
+		strings.Join(rm.dimensions, ","),
+		strings.Join(rm.aggregations, ","),
+		rm.window.interval.String(),
+		rm.window.timespan.String(),
+		rm.window.delay.String(),
+	}, "|")
+}
+
+// Returns the full ID of the resource whose metrics are queried
+func queriedResourceID(rm resourceMeta) string {
+	return strings.SplitN(rm.resourceURL, "/providers/microsoft.insights/metrics", 2)[0]
+}
+
+// getMetricsBatchResponseBody queries the metrics of resources sharing the same subscription, region, type and query
+// through the regional metrics:getBatch API.
+func (ac *AzureClient) getMetricsBatchResponseBody(resources []resourceMeta) ([]byte, error) {
+	rm := resources[0]
+	endpoint := strings.Replace(sc.C.MetricsDataPlaneURL, "{region}", strings.ToLower(rm.resource.Location), -1)
+	if !strings.HasSuffix(endpoint, "/") {
+		endpoint += "/"
+	}
+
+	endTime, startTime := GetTimes(rm.window.timespan, rm.window.delay)
+
+	values := url.Values{}
+	values.Add("metricnamespace", GetResourceType(rm.resourceURL))
+	if rm.metrics != "" {
+		values.Add("metricnames", rm.metrics)
+	}
+	values.Add("aggregation", strings.Join(filterAggregations(rm.aggregations), ","))
+	values.Add("starttime", startTime)
+	values.Add("endtime", endTime)
+	if rm.window.interval != 0 {
+		values.Add("interval", formatISO8601Duration(rm.window.interval))
+	}
+	if len(rm.dimensions) > 0 {
+		values.Add("filter", dimensionsFilter(rm.dimensions))
+		values.Add("top", strconv.Itoa(maxDimensionSeries))
+	}
+	values.Add("api-version", "2023-10-01")
+	apiURL := fmt.Sprintf("%ssubscriptions/%s/metrics:getBatch?%s", endpoint, rm.subscription, values.Encode())
+
+	var request metricsBatchRequest
+	for _, r := range resources {
+		request.ResourceIDs = append(request.ResourceIDs, queriedResourceID(r))
+	}
+	requestJSON, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// The data plane has its own limits, requests don't count against the Azure Resource Manager read limits
+	statusCode, body, err := ac.sendRequest("POST", apiURL, requestJSON, ac.metricsTokens, 0)
+	if err != nil {
+		return nil, err
+	}
+	if !isSuccessStatus(statusCode) {
+		return nil, fmt.Errorf("Error querying metrics batch, got status code %d: %s", statusCode, errorMessageOf(body))
+	}
+	return body, nil
+}
+
+// Returns whether metrics are collected through the metrics:getBatch API
+func usesDataPlane() bool {
+	return sc.C.MetricsBackend == config.DataPlaneMetricsBackend
+}
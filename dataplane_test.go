@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Returns a fake metrics data plane, serving for each resource of a metrics:getBatch request a value of 100 plus the
+// number in its name, in reverse order, and counting requests by region. Other requests get an empty list.
+func newFakeDataPlaneServer(t *testing.T, calls map[string]int, mtx *sync.Mutex) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 5 || parts[4] != "metrics:getBatch" {
+			// No metric definitions
+			fmt.Fprint(w, `{"value": []}`)
+			return
+		}
+		if r.URL.Query().Get("metricnamespace") != "Microsoft.Compute/virtualMachines" {
+			t.Errorf("doesn't query the metric namespace of the resource type\ngot: %s", r.URL.Query().Get("metricnamespace"))
+		}
+
+		var request metricsBatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+			return
+		}
+		mtx.Lock()
+		calls[parts[1]]++
+		mtx.Unlock()
+
+		var values []string
+		for i := len(request.ResourceIDs) - 1; i >= 0; i-- {
+			id := request.ResourceIDs[i]
+			var n int
+			fmt.Sscanf(id[strings.LastIndex(id, "/")+1:], "vm%d", &n)
+			values = append(values, fmt.Sprintf(`{"resourceid": %q, "value": [{"name": {"value": "Percentage CPU"}, "unit": "Percent",
+				"timeseries": [{"data": [{"timeStamp": "2020-01-01T00:00:00Z", "average": %d}]}]}]}`, id, 100+n))
+		}
+		fmt.Fprintf(w, `{"values": [%s]}`, strings.Join(values, ","))
+	}))
+}
+
+func TestDataPlaneCollectMetrics(t *testing.T) {
+	var mtx sync.Mutex
+	calls := make(map[string]int)
+	server := newFakeDataPlaneServer(t, calls, &mtx)
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{
+		ResourceManagerURL:  server.URL,
+		MetricsBackend:      config.DataPlaneMetricsBackend,
+		MetricsDataPlaneURL: server.URL + "/{region}/",
+	}
+	defer func() { sc.C = previous }()
+
+	settings := &metricSettings{block: "targets[0]"}
+	window := queryWindow{timespan: time.Minute}
+	var resources []resourceMeta
+	for i := 0; i < 70; i++ {
+		location := "westeurope"
+		if i >= 60 {
+			location = "eastus"
+		}
+		id := fmt.Sprintf("/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm%d", i)
+		resources = append(resources, resourceMeta{
+			resourceID:   id,
+			subscription: "sub",
+			resourceURL:  resourceURLFrom("sub", id, "Percentage CPU", nil, []string{"Average"}, window),
+			metrics:      "Percentage CPU",
+			aggregations: []string{"Average"},
+			window:       window,
+			resource:     AzureResource{ID: "/subscriptions/sub" + id, Location: location},
+			settings:     settings,
+		})
+	}
+
+	status := newScrapeStatus(settings.block)
+	ch := make(chan prometheus.Metric)
+	go func() {
+		(&Collector{}).collectMetrics(ch, resources, status)
+		close(ch)
+	}()
+
+	collected := 0
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		if pb.GetGauge().GetValue() == 1 {
+			// azure_resource_info
+			continue
+		}
+		collected++
+		for _, label := range pb.Label {
+			want := fmt.Sprintf("vm%d", int(pb.GetGauge().GetValue())-100)
+			if label.GetName() == "resource_name" && label.GetValue() != want {
+				t.Errorf("doesn't match values to their resources\ngot: %s\nwant: %s", label.GetValue(), want)
+			}
+		}
+	}
+
+	if collected != len(resources) {
+		t.Errorf("doesn't collect the metrics of every resource\ngot: %d\nwant: %d", collected, len(resources))
+	}
+	want := map[string]int{"westeurope": 2, "eastus": 1}
+	for region, n := range want {
+		if calls[region] != n {
+			t.Errorf("doesn't query resources of each region in batches of %d\ngot: %d calls for %s\nwant: %d", dataPlaneBatchSize, calls[region], region, n)
+		}
+	}
+}
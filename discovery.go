@@ -0,0 +1,422 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	discoveryCacheHitsDesc = prometheus.NewDesc(
+		"azure_discovery_cache_hits_total",
+		"Number of resource discoveries and lookups served from the discovery cache for the configuration block",
+		[]string{"block"}, nil,
+	)
+	discoveryCacheMissesDesc = prometheus.NewDesc(
+		"azure_discovery_cache_misses_total",
+		"Number of resource discoveries and lookups not found or expired in the discovery cache for the configuration block",
+		[]string{"block"}, nil,
+	)
+	discoveredResourcesDesc = prometheus.NewDesc(
+		"azure_discovered_resources",
+		"Number of resources discovered by the last collection of the configuration block",
+		[]string{"block"}, nil,
+	)
+)
+
+// Number of TTLs after which entries not read anymore, such as those of deleted resources, are evicted
+const discoveryCacheEvictionTTLs = 3
+
+type cacheEntry struct {
+	value      interface{}
+	updatedAt  time.Time
+	readAt     time.Time
+	refreshing bool
+}
+
+// discoveryCache holds discovered resources between collections for the configured TTL,
+// and counts cache hits, misses and discovered resources per configuration block.
+type discoveryCache struct {
+	mtx        sync.Mutex
+	entries    map[string]*cacheEntry
+	evictedAt  time.Time
+	hits       map[string]float64
+	misses     map[string]float64
+	discovered map[string]int
+}
+
+func newDiscoveryCache() *discoveryCache {
+	return &discoveryCache{
+		entries:    make(map[string]*cacheEntry),
+		hits:       make(map[string]float64),
+		misses:     make(map[string]float64),
+		discovered: make(map[string]int),
+	}
+}
+
+func (c *discoveryCache) ttl() time.Duration {
+	return time.Duration(sc.C.DiscoveryCacheTTL)
+}
+
+// get returns the cached value for key, calling fetch when it is missing. Expired values are
+// still returned while they are refreshed in the background.
+func (c *discoveryCache) get(block string, key string, fetch func() (interface{}, error)) (interface{}, error) {
+	if c.ttl() == 0 {
+		return fetch()
+	}
+
+	c.mtx.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		c.misses[block]++
+		c.mtx.Unlock()
+
+		value, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		c.set(key, value)
+		return value, nil
+	}
+
+	c.hits[block]++
+	entry.readAt = time.Now()
+	if time.Since(entry.updatedAt) > c.ttl() && !entry.refreshing && !budget.isExhausted() {
+		entry.refreshing = true
+		go c.refresh(key, entry, fetch)
+	}
+	value := entry.value
+	c.mtx.Unlock()
+	return value, nil
+}
+
+// refresh replaces an expired value, keeping it on failure so that it is retried on the next get.
+func (c *discoveryCache) refresh(key string, entry *cacheEntry, fetch func() (interface{}, error)) {
+	value, err := fetch()
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry.refreshing = false
+	if err != nil {
+		log.Printf("Failed to refresh discovery cache entry %s: %v", key, err)
+		return
+	}
+	entry.value = value
+	entry.updatedAt = time.Now()
+}
+
+// lookup returns the value cached for key if it has not expired, or if the API budget is exhausted
+// and stale values are to be served.
+func (c *discoveryCache) lookup(block string, key string) (interface{}, bool) {
+	if c.ttl() == 0 {
+		return nil, false
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	entry, ok := c.entries[key]
+	stale := ok && time.Since(entry.updatedAt) > c.ttl()
+	if stale && onBudgetExhausted(config.BudgetServeStale) && budget.isExhausted() {
+		stale = false
+	}
+	if !ok || stale {
+		c.misses[block]++
+		return nil, false
+	}
+	c.hits[block]++
+	entry.readAt = time.Now()
+	return entry.value, true
+}
+
+// set caches value for key.
+func (c *discoveryCache) set(key string, value interface{}) {
+	if c.ttl() == 0 {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	c.entries[key] = &cacheEntry{value: value, updatedAt: now, readAt: now}
+	c.evict(now)
+}
+
+// evict removes the entries not read for discoveryCacheEvictionTTLs, checking at most once per TTL.
+// It must be called with the lock held.
+func (c *discoveryCache) evict(now time.Time) {
+	if now.Sub(c.evictedAt) < c.ttl() {
+		return
+	}
+	c.evictedAt = now
+	for key, entry := range c.entries {
+		if now.Sub(entry.readAt) > discoveryCacheEvictionTTLs*c.ttl() {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// setDiscovered records the number of resources discovered by the last collection of a block.
+func (c *discoveryCache) setDiscovered(block string, count int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.discovered[block] = count
+}
+
+// Describe implemented with dummy data to satisfy interface.
+func (c *discoveryCache) Describe(ch chan<- *prometheus.Desc) {
+	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
+}
+
+// Collect - serve the discovery cache counters and discovered resources of each block.
+func (c *discoveryCache) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for block, hits := range c.hits {
+		ch <- prometheus.MustNewConstMetric(discoveryCacheHitsDesc, prometheus.CounterValue, hits, block)
+	}
+	for block, misses := range c.misses {
+		ch <- prometheus.MustNewConstMetric(discoveryCacheMissesDesc, prometheus.CounterValue, misses, block)
+	}
+	for block, count := range c.discovered {
+		ch <- prometheus.MustNewConstMetric(discoveredResourcesDesc, prometheus.GaugeValue, float64(count), block)
+	}
+}
+
+// Returns the key of the resource details cached by batchLookupResources
+func lookupCacheKey(subscription string, resourceID string) string {
+	return fmt.Sprintf("lookup/%s%s", subscription, resourceID)
+}
+
+// discoverTarget returns the resource metas of a target, to be looked up.
+func discoverTarget(block string, target config.Target) ([]resourceMeta, error) {
+	settings := &metricSettings{
+		block:          block,
+		metrics:        target.Metrics,
+		aggregations:   target.Aggregations,
+		window:         queryWindowFrom(target.Interval, target.Timespan, target.Delay),
+		labels:         target.Labels,
+		relabelConfigs: target.MetricRelabelConfigs,
+	}
+	subscriptions, err := ac.subscriptionsFrom(block, target.Subscriptions, false)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	var incompleteResources []resourceMeta
+	for _, subscription := range subscriptions {
+		incompleteResources = append(incompleteResources, resourceMetasFrom(subscription, target.Resource, settings)...)
+	}
+	return incompleteResources, nil
+}
+
+// discoverResourceGroup returns the resource metas of the resources of a resource group.
+func discoverResourceGroup(block string, resourceGroup config.ResourceGroup) ([]resourceMeta, error) {
+	settings := &metricSettings{
+		block:          block,
+		metrics:        resourceGroup.Metrics,
+		aggregations:   resourceGroup.Aggregations,
+		window:         queryWindowFrom(resourceGroup.Interval, resourceGroup.Timespan, resourceGroup.Delay),
+		labels:         resourceGroup.Labels,
+		relabelConfigs: resourceGroup.MetricRelabelConfigs,
+	}
+	subscriptions, err := ac.subscriptionsFrom(block, resourceGroup.Subscriptions, resourceGroup.AllSubscriptions)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	var resources []resourceMeta
+	for _, subscription := range subscriptions {
+		subscription := subscription
+		value, err := discoveries.get(block, fmt.Sprintf("%s/%s", block, subscription), func() (interface{}, error) {
+			return ac.filteredListFromResourceGroup(subscription, resourceGroup)
+		})
+		if err != nil {
+			log.Printf("Failed to get resources for resource group %s and resource types %s in subscription %s: %v",
+				resourceGroup.ResourceGroup, resourceGroup.ResourceTypes, subscription, err)
+			return nil, err
+		}
+
+		for _, f := range value.([]AzureResource) {
+			for _, rm := range resourceMetasFrom(subscription, f.ID, settings) {
+				rm.resource = f
+				resources = append(resources, rm)
+			}
+		}
+	}
+	return resources, nil
+}
+
+// discoverResourceType returns the resource metas of the resources of given types across subscriptions.
+func discoverResourceType(block string, resourceType config.ResourceType) ([]resourceMeta, error) {
+	settings := &metricSettings{
+		block:          block,
+		metrics:        resourceType.Metrics,
+		aggregations:   resourceType.Aggregations,
+		window:         queryWindowFrom(resourceType.Interval, resourceType.Timespan, resourceType.Delay),
+		labels:         resourceType.Labels,
+		relabelConfigs: resourceType.MetricRelabelConfigs,
+	}
+	subscriptions, err := ac.subscriptionsFrom(block, resourceType.Subscriptions, resourceType.AllSubscriptions)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	var resources []resourceMeta
+	for _, subscription := range subscriptions {
+		subscription := subscription
+		value, err := discoveries.get(block, fmt.Sprintf("%s/%s", block, subscription), func() (interface{}, error) {
+			return ac.filteredListFromSubscription(subscription, resourceType)
+		})
+		if err != nil {
+			log.Printf("Failed to get resources for resource types %s in subscription %s: %v", resourceType.ResourceTypes, subscription, err)
+			return nil, err
+		}
+
+		for _, f := range value.([]AzureResource) {
+			for _, rm := range resourceMetasFrom(subscription, f.ID, settings) {
+				rm.resource = f
+				resources = append(resources, rm)
+			}
+		}
+	}
+	return resources, nil
+}
+
+// discoverResourceTag returns the resource metas of the resources having a tag, to be looked up.
+func discoverResourceTag(block string, resourceTag config.ResourceTag, responses *responseCache) ([]resourceMeta, error) {
+	settings := &metricSettings{
+		block:          block,
+		metrics:        resourceTag.Metrics,
+		aggregations:   resourceTag.Aggregations,
+		window:         queryWindowFrom(resourceTag.Interval, resourceTag.Timespan, resourceTag.Delay),
+		labels:         resourceTag.Labels,
+		relabelConfigs: resourceTag.MetricRelabelConfigs,
+		filter:         &resourceTag.Filter,
+	}
+	subscriptions, err := ac.subscriptionsFrom(block, resourceTag.Subscriptions, resourceTag.AllSubscriptions)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	var incompleteResources []resourceMeta
+	for _, subscription := range subscriptions {
+		subscription := subscription
+		value, err := discoveries.get(block, fmt.Sprintf("%s/%s", block, subscription), func() (interface{}, error) {
+			return ac.filteredListByTag(subscription, resourceTag, responses)
+		})
+		if err != nil {
+			log.Printf("Failed to get resources for tag name %s, tag value %s in subscription %s: %v",
+				resourceTag.ResourceTagName, resourceTag.ResourceTagValue, subscription, err)
+			return nil, err
+		}
+
+		for _, f := range value.([]AzureResource) {
+			incompleteResources = append(incompleteResources, resourceMetasFrom(subscription, f.ID, settings)...)
+		}
+	}
+	return incompleteResources, nil
+}
+
+// discoverResourceQuery returns the resource metas of the resources returned by a resource graph query, to be looked up.
+func discoverResourceQuery(block string, resourceQuery config.ResourceQuery) ([]resourceMeta, error) {
+	settings := &metricSettings{
+		block:          block,
+		metrics:        resourceQuery.Metrics,
+		aggregations:   resourceQuery.Aggregations,
+		window:         queryWindowFrom(resourceQuery.Interval, resourceQuery.Timespan, resourceQuery.Delay),
+		labels:         resourceQuery.Labels,
+		relabelConfigs: resourceQuery.MetricRelabelConfigs,
+		filter:         &resourceQuery.Filter,
+	}
+	subscriptions, err := ac.subscriptionsFrom(block, resourceQuery.Subscriptions, resourceQuery.AllSubscriptions)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+
+	value, err := discoveries.get(block, block, func() (interface{}, error) {
+		return ac.queryResources(subscriptions, resourceQuery.Query)
+	})
+	if err != nil {
+		log.Printf("Failed to get resources for query %q: %v", resourceQuery.Query, err)
+		return nil, err
+	}
+
+	var incompleteResources []resourceMeta
+	for _, row := range value.([]map[string]interface{}) {
+		id, _ := row["id"].(string)
+		subscription, resourceID, _, err := ParseProbeTarget(id)
+		if err != nil || subscription == "" || resourceID == "" {
+			log.Printf("Skipping row of query %q without a valid resource id: %v", resourceQuery.Query, row)
+			continue
+		}
+
+		labels := resourceQueryLabels(row)
+		for _, rm := range resourceMetasFrom(subscription, resourceID, settings) {
+			rm.labels = labels
+			incompleteResources = append(incompleteResources, rm)
+		}
+	}
+	return incompleteResources, nil
+}
+
+// discoverBlock returns the resource metas of the resources discovered by a block: complete ones,
+// and incomplete ones which need to be looked up.
+func discoverBlock(b *collectionBlock, responses *responseCache) ([]resourceMeta, []resourceMeta, error) {
+	var complete, incomplete []resourceMeta
+	for _, target := range b.targets {
+		found, err := discoverTarget(b.name, target)
+		if err != nil {
+			return nil, nil, err
+		}
+		incomplete = append(incomplete, found...)
+	}
+	for _, resourceGroup := range b.resourceGroups {
+		found, err := discoverResourceGroup(b.name, resourceGroup)
+		if err != nil {
+			return nil, nil, err
+		}
+		complete = append(complete, found...)
+	}
+	for _, resourceType := range b.resourceTypes {
+		found, err := discoverResourceType(b.name, resourceType)
+		if err != nil {
+			return nil, nil, err
+		}
+		complete = append(complete, found...)
+	}
+	for _, resourceTag := range b.resourceTags {
+		found, err := discoverResourceTag(b.name, resourceTag, responses)
+		if err != nil {
+			return nil, nil, err
+		}
+		incomplete = append(incomplete, found...)
+	}
+	for _, resourceQuery := range b.resourceQueries {
+		found, err := discoverResourceQuery(b.name, resourceQuery)
+		if err != nil {
+			return nil, nil, err
+		}
+		incomplete = append(incomplete, found...)
+	}
+	return complete, incomplete, nil
+}
+
+// Returns the number of distinct resources among resource metas
+func countResources(resources []resourceMeta) int {
+	seen := make(map[string]bool)
+	for _, rm := range resources {
+		seen[rm.subscription+rm.resourceID] = true
+	}
+	return len(seen)
+}
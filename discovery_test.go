@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+func TestDiscoveryCacheGet(t *testing.T) {
+	previous := sc.C
+	sc.C = &config.Config{DiscoveryCacheTTL: model.Duration(time.Minute)}
+	defer func() { sc.C = previous }()
+
+	c := newDiscoveryCache()
+	fetches := 0
+	refreshed := make(chan struct{}, 1)
+	fetch := func() (interface{}, error) {
+		fetches++
+		if fetches > 1 {
+			refreshed <- struct{}{}
+		}
+		return fetches, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		got, err := c.get("resource_groups[0]", "key", fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != 1 {
+			t.Errorf("doesn't serve cached value\ngot: %v\nwant: %v", got, 1)
+		}
+	}
+	if c.misses["resource_groups[0]"] != 1 || c.hits["resource_groups[0]"] != 1 {
+		t.Errorf("unexpected hits and misses\ngot: %v, %v\nwant: 1, 1", c.hits["resource_groups[0]"], c.misses["resource_groups[0]"])
+	}
+
+	// An expired value is served while it is refreshed in the background
+	c.entries["key"].updatedAt = time.Now().Add(-2 * time.Minute)
+	got, _ := c.get("resource_groups[0]", "key", fetch)
+	if got != 1 {
+		t.Errorf("doesn't serve expired value during refresh\ngot: %v\nwant: %v", got, 1)
+	}
+	<-refreshed
+
+	c.mtx.Lock()
+	refreshing := c.entries["key"].refreshing
+	c.mtx.Unlock()
+	for refreshing {
+		time.Sleep(time.Millisecond)
+		c.mtx.Lock()
+		refreshing = c.entries["key"].refreshing
+		c.mtx.Unlock()
+	}
+
+	got, _ = c.get("resource_groups[0]", "key", fetch)
+	if got != 2 {
+		t.Errorf("doesn't serve refreshed value\ngot: %v\nwant: %v", got, 2)
+	}
+}
+
+func TestSubscriptionsFromCachesAllSubscriptions(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, `{"value": [{"subscriptionId": "sub1", "state": "Enabled"}, {"subscriptionId": "sub2", "state": "Enabled"}]}`)
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL, DiscoveryCacheTTL: model.Duration(time.Minute)}
+	defer func() { sc.C = previous }()
+	previousDiscoveries := discoveries
+	discoveries = newDiscoveryCache()
+	defer func() { discoveries = previousDiscoveries }()
+
+	for _, block := range []string{"resource_groups[0]", "resource_tags[0]"} {
+		got, err := ac.subscriptionsFrom(block, nil, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"sub1", "sub2"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("doesn't return all subscriptions\ngot: %v\nwant: %v", got, want)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("doesn't cache the list of subscriptions\ngot: %d requests\nwant: %d", requests, 1)
+	}
+}
+
+func TestDiscoveryCacheEvictsUnreadEntries(t *testing.T) {
+	previous := sc.C
+	sc.C = &config.Config{DiscoveryCacheTTL: model.Duration(time.Minute)}
+	defer func() { sc.C = previous }()
+
+	c := newDiscoveryCache()
+	c.set("read", 1)
+	c.set("unread", 2)
+	c.entries["read"].readAt = time.Now().Add(-time.Minute)
+	c.entries["unread"].readAt = time.Now().Add(-4 * time.Minute)
+	c.evictedAt = time.Now().Add(-2 * time.Minute)
+
+	c.set("new", 3)
+
+	if _, ok := c.entries["unread"]; ok {
+		t.Errorf("doesn't evict entries not read for %d TTLs", discoveryCacheEvictionTTLs)
+	}
+	if _, ok := c.lookup("resource_groups[0]", "read"); !ok {
+		t.Errorf("evicts entries read recently")
+	}
+}
+
+func TestResourceTagFilterAppliedAfterLookup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/batch"):
+			var batch batchBody
+			if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+				t.Error(err)
+				return
+			}
+			var responses []string
+			for _, req := range batch.Requests {
+				id := strings.Split(req.RelativeURL, "?")[0]
+				content := fmt.Sprintf(`{"id": %q, "tags": {"env": "prod"}}`, id)
+				if strings.Contains(id, "/microsoft.insights/metrics") {
+					content = `{"value": [{"name": {"value": "Percentage CPU"}, "unit": "Percent",
+						"timeseries": [{"data": [{"timeStamp": "2020-01-01T00:00:00Z", "average": 1}]}]}]}`
+				} else if strings.HasSuffix(id, "/vm2") {
+					content = fmt.Sprintf(`{"id": %q, "tags": {"env": "dev"}}`, id)
+				}
+				responses = append(responses, fmt.Sprintf(`{"name": %q, "httpStatusCode": 200, "content": %s}`, req.Name, content))
+			}
+			fmt.Fprintf(w, `{"responses": [%s]}`, strings.Join(responses, ","))
+		case strings.HasSuffix(r.URL.Path, "/resources"):
+			// Listing resources by tag does not return their tags
+			fmt.Fprint(w, `{"value": [
+				{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", "name": "vm1"},
+				{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2", "name": "vm2"}
+			]}`)
+		default:
+			// No metric definitions
+			fmt.Fprint(w, `{"value": []}`)
+		}
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{
+		ResourceManagerURL: server.URL,
+		Credentials:        config.Credentials{SubscriptionID: "sub"},
+		ResourceTags: []config.ResourceTag{{
+			ResourceTagName:  "monitored",
+			ResourceTagValue: "true",
+			Metrics:          []config.Metric{{Name: "Percentage CPU"}},
+			Filter:           config.ResourceFilter{Tags: []config.TagFilter{{Name: "env", Value: "prod"}}},
+		}},
+	}
+	defer func() { sc.C = previous }()
+	previousVersions := ac.APIVersions
+	ac.APIVersions = APIVersionMap{"Microsoft.Compute/virtualMachines": "2019-07-01"}
+	defer func() { ac.APIVersions = previousVersions }()
+
+	ch := make(chan prometheus.Metric, 100)
+	(&Collector{}).collectBlocks(ch, collectionBlocksFrom(sc.C))
+	close(ch)
+
+	var names []string
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		for _, label := range pb.Label {
+			if label.GetName() == "resource_name" {
+				names = append(names, label.GetValue())
+			}
+		}
+	}
+	if want := []string{"vm1", "vm1"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("doesn't filter tagged resources by the tags they are looked up with\ngot: %v\nwant: %v", names, want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Retries of throttled requests and transient failures, with exponential backoff between retryBaseDelay and retryMaxDelay
+	maxRetries     = 4
+	retryBaseDelay = time.Second
+	retryMaxDelay  = time.Minute
+
+	remainingReadsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "azure_ratelimit_remaining_subscription_reads",
+		Help: "Remaining subscription reads before Azure Resource Manager throttles requests, as of the last response",
+	})
+)
+
+// sendAzureRequest sends a request to Azure Resource Manager, retrying throttled requests and transient failures.
+// Each attempt consumes cost requests of the API budget and waits for a free request slot. It returns the status code and body of the last response.
+func (ac *AzureClient) sendAzureRequest(method string, endpoint string, body []byte, cost int) (int, []byte, error) {
+	return ac.sendRequest(method, endpoint, body, ac.tokens, cost)
+}
+
+// sendRequest sends a request authenticated with a token of the given source, retrying as sendAzureRequest does.
+func (ac *AzureClient) sendRequest(method string, endpoint string, body []byte, tokens *tokenSource, cost int) (int, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		if !budget.take(cost) {
+			return 0, nil, errBudgetExhausted
+		}
+
+		// The token is checked on each attempt, as retries may outlive it
+		token, err := tokens.get()
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error getting access token: %v", err)
+		}
+
+		var reqBody io.Reader
+		if body != nil {
+			reqBody = bytes.NewReader(body)
+		}
+		req, err := http.NewRequest(method, endpoint, reqBody)
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error creating HTTP request: %v", err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		acquireRequestSlot()
+		resp, err := ac.client.Do(req)
+		if err != nil {
+			releaseRequestSlot()
+			if attempt < maxRetries {
+				delay := backoffDelay(attempt)
+				log.Printf("Request to %s failed, retrying in %s: %v", endpoint, delay, err)
+				time.Sleep(delay)
+				continue
+			}
+			return 0, nil, fmt.Errorf("Error: %v", err)
+		}
+
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		releaseRequestSlot()
+		if err != nil {
+			return 0, nil, fmt.Errorf("Error reading body of response: %v", err)
+		}
+
+		if remaining, err := strconv.ParseFloat(resp.Header.Get("x-ms-ratelimit-remaining-subscription-reads"), 64); err == nil {
+			remainingReadsGauge.Set(remaining)
+		}
+
+		if isRetryableStatus(resp.StatusCode) && attempt < maxRetries {
+			delay, ok := retryAfterDelay(resp.Header.Get("Retry-After"))
+			if !ok {
+				delay = backoffDelay(attempt)
+			}
+			log.Printf("Request to %s returned status code %d, retrying in %s", endpoint, resp.StatusCode, delay)
+			time.Sleep(delay)
+			continue
+		}
+		return resp.StatusCode, respBody, nil
+	}
+}
+
+// Returns whether a request failing with the status code may succeed when retried
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Returns the delay requested by a Retry-After header, given in seconds or as an HTTP date, capped to retryMaxDelay
+func retryAfterDelay(retryAfter string) (time.Duration, bool) {
+	if retryAfter == "" {
+		return 0, false
+	}
+
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(retryAfter); err == nil {
+		delay = time.Until(date)
+	} else {
+		return 0, false
+	}
+
+	if delay < 0 {
+		delay = 0
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay, true
+}
+
+// Returns a jittered exponential backoff delay for the given retry attempt, between half and all of
+// retryBaseDelay * 2^attempt, capped to retryMaxDelay
+func backoffDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
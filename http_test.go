@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestSendAzureRequestRetries(t *testing.T) {
+	previous := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	defer func() { retryBaseDelay = previous }()
+
+	var cases = []struct {
+		statuses   []int
+		wantStatus int
+		wantCalls  int
+	}{
+		{[]int{http.StatusTooManyRequests, http.StatusOK}, http.StatusOK, 2},
+		{[]int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, http.StatusOK, 3},
+		{[]int{http.StatusNotFound}, http.StatusNotFound, 1},
+		{[]int{500, 500, 500, 500, 500, 500}, 500, maxRetries + 1},
+	}
+
+	for _, c := range cases {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status := c.statuses[calls]
+			calls++
+			w.Header().Set("x-ms-ratelimit-remaining-subscription-reads", "11999")
+			if status == http.StatusTooManyRequests {
+				w.Header().Set("Retry-After", "0")
+			}
+			w.WriteHeader(status)
+		}))
+
+		status, _, err := ac.sendAzureRequest("GET", server.URL, nil, 1)
+		server.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != c.wantStatus || calls != c.wantCalls {
+			t.Errorf("doesn't retry as expected for %v\ngot: status %d after %d calls\nwant: status %d after %d calls", c.statuses, status, calls, c.wantStatus, c.wantCalls)
+		}
+	}
+
+	var m dto.Metric
+	if err := remainingReadsGauge.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.GetGauge().GetValue(); got != 11999 {
+		t.Errorf("doesn't record remaining subscription reads\ngot: %v\nwant: %v", got, 11999)
+	}
+}
+
+func TestRetryAfterDelay(t *testing.T) {
+	var cases = []struct {
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"3600", retryMaxDelay, true},
+		{"Mon, 01 Jan 2001 00:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+
+	for _, c := range cases {
+		got, ok := retryAfterDelay(c.header)
+		if got != c.want || ok != c.ok {
+			t.Errorf("doesn't parse Retry-After %q\ngot: %v, %v\nwant: %v, %v", c.header, got, ok, c.want, c.ok)
+		}
+	}
+}
@@ -6,8 +6,9 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/RobustPerception/azure_metrics_exporter/config"
 
@@ -26,9 +27,12 @@ var (
 	configFile            = kingpin.Flag("config.file", "Azure exporter configuration file.").Default("azure.yml").String()
 	listenAddress         = kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests.").Default(":9276").String()
 	listMetricDefinitions = kingpin.Flag("list.definitions", "List available metric definitions for the given resources and exit.").Bool()
-	invalidMetricChars    = regexp.MustCompile("[^a-zA-Z0-9_:]")
 	azureErrorDesc        = prometheus.NewDesc("azure_error", "Error collecting metrics", nil, nil)
 	batchSize             = 20
+	scheduler             *Scheduler
+	metricHelps           = &helpTexts{texts: make(map[string]string)}
+	discoveries           = newDiscoveryCache()
+	budget                *apiBudget
 )
 
 func init() {
@@ -45,94 +49,316 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 
 type resourceMeta struct {
 	resourceID   string
+	subscription string
 	resourceURL  string
 	metrics      string
+	dimensions   []string
 	aggregations []string
+	window       queryWindow
 	resource     AzureResource
+	settings     *metricSettings
+
+	// Labels of the resource found by discovery, added to each of its series
+	labels map[string]string
+
+	// Primary aggregation of each metric by lowercased name, when collecting primary aggregations only
+	primaryAggregations map[string]string
 }
 
-func (c *Collector) extractMetrics(ch chan<- prometheus.Metric, rm resourceMeta, httpStatusCode int, metricValueData AzureMetricValueResponse, publishedResources map[string]bool) {
-	if httpStatusCode != 200 {
-		log.Printf("Received %d status for resource %s. %s", httpStatusCode, rm.resourceURL, metricValueData.APIError.Message)
-		return
+// Returns a resourceMeta for each group of metrics to query on the given resource
+func resourceMetasFrom(subscription string, resourceID string, settings *metricSettings) []resourceMeta {
+	aggregations := settings.aggregations
+	window := settings.window
+	var primaryAggregations map[string]string
+	if len(aggregations) == 1 && aggregations[0] == config.PrimaryAggregation {
+		var err error
+		primaryAggregations, err = primaryAggregationsOf(subscription, resourceID)
+		if err != nil {
+			log.Printf("Failed to get primary aggregations for resource %s, using default aggregations: %v", resourceID, err)
+		}
+		aggregations = nil
+	}
+
+	metrics := supportedMetrics(subscription, resourceID, settings.metrics, window.interval)
+	var timeGrains map[string]time.Duration
+	if window.interval == 0 {
+		timeGrains = defaultTimeGrains(subscription, resourceID, metrics)
+	}
+
+	// Each group is queried separately, the metrics of a resource being reassembled from all of its requests
+	var resources []resourceMeta
+	for _, group := range groupMetrics(metrics, timeGrains) {
+		var rm resourceMeta
+		rm.resourceID = resourceID
+		rm.subscription = subscription
+		rm.settings = settings
+		rm.metrics = group.names
+		rm.dimensions = group.dimensions
+		rm.aggregations = filterAggregations(aggregations)
+		if primaryAggregations != nil {
+			rm.aggregations = aggregationsFor(strings.Split(group.names, ","), primaryAggregations)
+			rm.primaryAggregations = primaryAggregations
+		}
+		groupWindow := window
+		if group.timeGrain != 0 {
+			groupWindow.interval = group.timeGrain
+			if groupWindow.timespan < group.timeGrain {
+				groupWindow.timespan = group.timeGrain
+			}
+		}
+		rm.window = groupWindow
+		rm.resourceURL = resourceURLFrom(subscription, resourceID, rm.metrics, rm.dimensions, rm.aggregations, groupWindow)
+		resources = append(resources, rm)
+	}
+	return resources
+}
+
+// Returns the primary aggregation of each metric of the resource, by lowercased metric name
+func primaryAggregationsOf(subscription string, resourceID string) (map[string]string, error) {
+	definitions, err := ac.getCachedMetricDefinitions(subscription, resourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	primaryAggregations := make(map[string]string)
+	for _, def := range definitions.MetricDefinitionResponses {
+		for _, aggregation := range aggregationSuffixes {
+			if strings.EqualFold(def.PrimaryAggregationType, aggregation.name) {
+				primaryAggregations[strings.ToLower(def.Name.Value)] = aggregation.name
+				break
+			}
+		}
+	}
+	return primaryAggregations, nil
+}
+
+// Returns the metrics available with the given time grain, according to the metric definitions of the resource
+func supportedMetrics(subscription string, resourceID string, metrics []config.Metric, interval time.Duration) []config.Metric {
+	if interval == 0 {
+		return metrics
+	}
+
+	definitions, err := ac.getCachedMetricDefinitions(subscription, resourceID)
+	if err != nil {
+		log.Printf("Failed to get metric definitions for resource %s, interval is not validated: %v", resourceID, err)
+		return metrics
+	}
+
+	var supported []config.Metric
+	for _, metric := range metrics {
+		def, ok := definitions.definitionOf(metric.Name)
+		if ok && !def.supportsTimeGrain(interval) {
+			log.Printf("Metric %s of resource %s is not available with interval %s, skipping it", metric.Name, resourceID, formatISO8601Duration(interval))
+			continue
+		}
+		supported = append(supported, metric)
+	}
+	return supported
+}
+
+// Returns the time grain of each metric not available with the default time grain of one minute, so that it is
+// queried separately with its finest available time grain
+func defaultTimeGrains(subscription string, resourceID string, metrics []config.Metric) map[string]time.Duration {
+	definitions, err := ac.getCachedMetricDefinitions(subscription, resourceID)
+	if err != nil {
+		log.Printf("Failed to get metric definitions for resource %s, using the default time grain: %v", resourceID, err)
+		return nil
+	}
+
+	timeGrains := make(map[string]time.Duration)
+	for _, metric := range metrics {
+		def, ok := definitions.definitionOf(metric.Name)
+		if !ok || def.supportsTimeGrain(time.Minute) {
+			continue
+		}
+		if timeGrain, ok := def.finestTimeGrain(); ok {
+			timeGrains[metric.Name] = timeGrain
+		}
+	}
+	return timeGrains
+}
+
+// helpTexts holds the help text of each metric name. A metric family must have a single help text,
+// so a metric exported for several resource types keeps the help text of the first one collected.
+type helpTexts struct {
+	sync.Mutex
+	texts map[string]string
+}
+
+// get returns the help text of the metric, setting it to help if it has none yet
+func (h *helpTexts) get(metricName string, help string) string {
+	h.Lock()
+	defer h.Unlock()
+	if existing, ok := h.texts[metricName]; ok {
+		return existing
+	}
+	h.texts[metricName] = help
+	return help
+}
+
+// newGaugeMetric returns a gauge with the given value, explicitly timestamped unless timestamp is zero.
+func newGaugeMetric(desc *prometheus.Desc, value float64, timestamp time.Time) (prometheus.Metric, error) {
+	metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, value)
+	if err != nil || timestamp.IsZero() {
+		return metric, err
 	}
+	return prometheus.NewMetricWithTimestamp(timestamp, metric), nil
+}
 
+func (c *Collector) extractMetrics(ch chan<- prometheus.Metric, rm resourceMeta, metricValueData AzureMetricValueResponse, publishedResources *publishedSet) {
 	if len(metricValueData.Value) == 0 || len(metricValueData.Value[0].Timeseries) == 0 {
 		log.Printf("Metric %v not found at target %v\n", rm.metrics, rm.resourceURL)
 		return
 	}
-	if len(metricValueData.Value[0].Timeseries[0].Data) == 0 {
-		log.Printf("No metric data returned for metric %v at target %v\n", rm.metrics, rm.resourceURL)
-		return
+
+	// Definitions are cached per resource type, they only cost an API call for the first resource of a type
+	definitions, err := ac.getCachedMetricDefinitions(rm.subscription, rm.resourceID)
+	if err != nil {
+		log.Printf("Failed to get metric definitions for resource %s, using metric names as help: %v", rm.resourceID, err)
+		definitions = &AzureMetricDefinitionResponse{}
 	}
+	resourceType := GetResourceType(rm.resourceURL)
 
 	for _, value := range metricValueData.Value {
-		// Ensure Azure metric names conform to Prometheus metric name conventions
-		metricName := strings.Replace(value.Name.Value, " ", "_", -1)
-		metricName = strings.ToLower(metricName + "_" + value.Unit)
-		metricName = strings.Replace(metricName, "/", "_per_", -1)
-		metricName = invalidMetricChars.ReplaceAllString(metricName, "_")
-
-		if len(value.Timeseries) > 0 {
-			metricValue := value.Timeseries[0].Data[len(value.Timeseries[0].Data)-1]
-			labels := CreateResourceLabels(rm.resourceURL)
+		def, hasDefinition := definitions.definitionOf(value.Name.Value)
 
-			if hasAggregation(rm.aggregations, "Total") {
-				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(metricName+"_total", metricName+"_total", nil, labels),
-					prometheus.GaugeValue,
-					metricValue.Total,
-				)
-			}
+		aggregations := rm.aggregations
+		if primary, ok := rm.primaryAggregations[strings.ToLower(value.Name.Value)]; ok {
+			aggregations = []string{primary}
+		}
 
-			if hasAggregation(rm.aggregations, "Average") {
-				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(metricName+"_average", metricName+"_average", nil, labels),
-					prometheus.GaugeValue,
-					metricValue.Average,
-				)
+		// With dimensions, Azure returns one timeseries per combination of dimension values
+		for _, series := range value.Timeseries {
+			if len(series.Data) == 0 {
+				log.Printf("No metric data returned for metric %v at target %v\n", value.Name.Value, rm.resourceURL)
+				continue
 			}
 
-			if hasAggregation(rm.aggregations, "Minimum") {
-				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(metricName+"_min", metricName+"_min", nil, labels),
-					prometheus.GaugeValue,
-					metricValue.Minimum,
-				)
+			// Resources of the same name may be collected from several subscriptions
+			labels := CreateResourceLabels(rm.resourceURL)
+			labels["azure_subscription"] = rm.subscription
+			for k, v := range rm.labels {
+				labels[k] = v
+			}
+			for _, dimension := range series.Metadatavalues {
+				labels[dimensionLabelName(dimension.Name.Value)] = dimension.Value
 			}
 
-			if hasAggregation(rm.aggregations, "Maximum") {
-				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(metricName+"_max", metricName+"_max", nil, labels),
-					prometheus.GaugeValue,
-					metricValue.Maximum,
+			for _, aggregation := range aggregationSuffixes {
+				if !hasAggregation(aggregations, aggregation.name) {
+					continue
+				}
+
+				// Azure omits aggregations without values, typically in the last data point
+				dataPoint, metricValue, ok := lastValueOf(series.Data, aggregation.name)
+				if !ok {
+					continue
+				}
+
+				var timestamp time.Time
+				if sc.C.UseAzureTimestamps {
+					var err error
+					timestamp, err = time.Parse(time.RFC3339, dataPoint.TimeStamp)
+					if err != nil {
+						log.Printf("Invalid timestamp %q for metric %v at target %v: %v", dataPoint.TimeStamp, value.Name.Value, rm.resourceURL, err)
+					}
+				}
+
+				metricConfig := rm.settings.metricConfigOf(value.Name.Value)
+				metricName, scale := exportedMetricName(value.Name.Value, value.Unit, aggregation.name, metricConfig.Rename)
+				metricName, metricLabels, keep := rm.settings.applyLabels(metricName, labels, metricConfig)
+				if !keep {
+					continue
+				}
+
+				// Series without definition go through the help texts too, as another resource type
+				// may export the same metric name with its definition in the same collection
+				help := metricName
+				if hasDefinition {
+					help = metricHelp(def, resourceType, aggregation.name)
+				}
+				help = metricHelps.get(metricName, help)
+
+				// Relabeling may still produce labels Prometheus rejects, which must not panic the collection
+				metric, err := newGaugeMetric(
+					prometheus.NewDesc(metricName, help, nil, metricLabels),
+					metricValue*scale,
+					timestamp,
 				)
+				if err != nil {
+					log.Printf("Invalid metric %s for metric %v at target %v: %v", metricName, value.Name.Value, rm.resourceURL, err)
+					continue
+				}
+				ch <- metric
 			}
 		}
 	}
 
-	if _, ok := publishedResources[rm.resource.ID]; !ok {
+	if publishedResources.add(rm.subscription + rm.resource.ID) {
 		infoLabels := CreateAllResourceLabelsFrom(rm)
-		ch <- prometheus.MustNewConstMetric(
+		metric, err := prometheus.NewConstMetric(
 			prometheus.NewDesc("azure_resource_info", "Azure information available for resource", nil, infoLabels),
 			prometheus.GaugeValue,
 			1,
 		)
-		publishedResources[rm.resource.ID] = true
+		if err != nil {
+			log.Printf("Invalid azure_resource_info metric for resource %s: %v", rm.resourceID, err)
+			return
+		}
+		ch <- metric
 	}
 }
 
-func (c *Collector) batchCollectMetrics(ch chan<- prometheus.Metric, resources []resourceMeta) {
-	var publishedResources = map[string]bool{}
+// publishedSet records the resources whose info metric was published, shared by concurrent batches.
+type publishedSet struct {
+	sync.Mutex
+	keys map[string]bool
+}
 
-	// collect metrics in batches
-	for i := 0; i < len(resources); i += batchSize {
-		j := i + batchSize
+// add records a resource, returning false if it was already published.
+func (p *publishedSet) add(key string) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.keys[key] {
+		return false
+	}
+	p.keys[key] = true
+	return true
+}
+
+// Returns the start and end indexes of the batches splitting n requests into batches of the given size
+func batchRanges(n int, size int) [][2]int {
+	var ranges [][2]int
+	for i := 0; i < n; i += size {
+		j := i + size
 
 		// don't forget to add remainder resources
-		if j > len(resources) {
-			j = len(resources)
+		if j > n {
+			j = n
 		}
+		ranges = append(ranges, [2]int{i, j})
+	}
+	return ranges
+}
+
+// collectMetrics collects the metrics of resources with the configured metrics backend.
+func (c *Collector) collectMetrics(ch chan<- prometheus.Metric, resources []resourceMeta, status *scrapeStatus) {
+	if usesDataPlane() {
+		c.dataPlaneCollectMetrics(ch, resources, status)
+		return
+	}
+	c.batchCollectMetrics(ch, resources, status)
+}
+
+// batchCollectMetrics collects the metrics of resources in batches sent concurrently. A failed batch marks the blocks
+// of its resources as failed without affecting the other batches.
+func (c *Collector) batchCollectMetrics(ch chan<- prometheus.Metric, resources []resourceMeta, status *scrapeStatus) {
+	publishedResources := &publishedSet{keys: map[string]bool{}}
+
+	// collect metrics in batches
+	batches := batchRanges(len(resources), batchSize)
+	forEachConcurrently(len(batches), func(b int) {
+		i, j := batches[b][0], batches[b][1]
 
 		var urls []string
 		for _, r := range resources[i:j] {
@@ -141,163 +367,364 @@ func (c *Collector) batchCollectMetrics(ch chan<- prometheus.Metric, resources [
 
 		batchBody, err := ac.getBatchResponseBody(urls)
 		if err != nil {
-			ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+			log.Printf("Failed to get metrics of %d resources: %v", j-i, err)
+			status.failResources(resources[i:j], reasonBatch, err)
 			return
 		}
 
 		var batchData AzureBatchMetricResponse
 		err = json.Unmarshal(batchBody, &batchData)
 		if err != nil {
-			ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+			log.Printf("Failed to unmarshal metrics of %d resources: %v", j-i, err)
+			status.failResources(resources[i:j], reasonBatch, err)
 			return
 		}
 
-		for k, resp := range batchData.Responses {
-			c.extractMetrics(ch, resources[i+k], resp.HttpStatusCode, resp.Content, publishedResources)
+		answered := make([]bool, j-i)
+		for _, resp := range batchData.Responses {
+			k, ok := batchResponseIndex(resp.Name, j-i)
+			if !ok || answered[k] {
+				log.Printf("Ignoring unexpected response %q in batch of %d resources", resp.Name, j-i)
+				continue
+			}
+			answered[k] = true
+
+			if !isSuccessStatus(resp.HttpStatusCode) {
+				batchItemFailed(status, resources[i+k], reasonBatch, resp.HttpStatusCode, resp.Content.APIError.Message)
+				continue
+			}
+			c.extractMetrics(ch, resources[i+k], resp.Content, publishedResources)
 		}
-	}
+		for k := range answered {
+			if !answered[k] {
+				batchItemFailed(status, resources[i+k], reasonBatch, 0, "no response in batch")
+			}
+		}
+	})
 }
 
-func (c *Collector) batchLookupResources(resources []resourceMeta) ([]resourceMeta, error) {
+// batchLookupResources looks up the details of resources in batches, returning the resources found.
+// Resources which fail to be looked up mark their blocks as failed and are left out.
+func (c *Collector) batchLookupResources(resources []resourceMeta, status *scrapeStatus) []resourceMeta {
 	var updatedResources = resources
-	// collect resource info in batches
-	for i := 0; i < len(resources); i += batchSize {
-		j := i + batchSize
+	found := make([]bool, len(resources))
+
+	// resource info is cached between collections, only look up the others, once per resource
+	// as several metas of the same resource may be collected by one or more blocks
+	var uncached [][]int
+	lookups := make(map[string]int)
+	for i, r := range updatedResources {
+		key := lookupCacheKey(r.subscription, r.resourceID)
+		if resource, ok := discoveries.lookup(r.settings.block, key); ok {
+			updatedResources[i].resource = resource.(AzureResource)
+			found[i] = true
+			continue
+		}
+		if k, ok := lookups[key]; ok {
+			uncached[k] = append(uncached[k], i)
+			continue
+		}
+		lookups[key] = len(uncached)
+		uncached = append(uncached, []int{i})
+	}
 
-		// don't forget to add remainder resources
-		if j > len(resources) {
-			j = len(resources)
+	// Returns the metas of a looked up resource
+	metasOf := func(indexes []int) []resourceMeta {
+		metas := make([]resourceMeta, 0, len(indexes))
+		for _, index := range indexes {
+			metas = append(metas, resources[index])
+		}
+		return metas
+	}
+
+	// A failed lookup is reported once for each block collecting the resource
+	lookupFailed := func(indexes []int, statusCode int, message string) {
+		blocks := make(map[string]bool)
+		for _, index := range indexes {
+			if rm := resources[index]; !blocks[rm.settings.block] {
+				blocks[rm.settings.block] = true
+				batchItemFailed(status, rm, reasonLookup, statusCode, message)
+			}
 		}
+	}
+
+	// collect resource info in batches sent concurrently, each batch updating the resources at its own indexes
+	batches := batchRanges(len(uncached), batchSize)
+	forEachConcurrently(len(batches), func(b int) {
+		i, j := batches[b][0], batches[b][1]
 
 		var urls []string
-		for _, r := range resources[i:j] {
+		var batch [][]int
+		for _, indexes := range uncached[i:j] {
+			r := resources[indexes[0]]
 			resourceType := GetResourceType(r.resourceURL)
 			if resourceType == "" {
-				return nil, fmt.Errorf("No type found for resource: %s", r.resourceID)
+				err := fmt.Errorf("No type found for resource: %s", r.resourceID)
+				log.Println(err)
+				status.failResources(metasOf(indexes), reasonLookup, err)
+				continue
 			}
 
 			apiVersion := ac.APIVersions.findBy(resourceType)
 			if apiVersion == "" {
-				return nil, fmt.Errorf("No api version found for type: %s", resourceType)
+				err := fmt.Errorf("No api version found for type: %s", resourceType)
+				log.Println(err)
+				status.failResources(metasOf(indexes), reasonLookup, err)
+				continue
 			}
 
-			subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
+			subscription := fmt.Sprintf("subscriptions/%s", r.subscription)
 			resourcesEndpoint := fmt.Sprintf("/%s/%s?api-version=%s", subscription, r.resourceID, apiVersion)
 
 			urls = append(urls, resourcesEndpoint)
+			batch = append(batch, indexes)
+		}
+		if len(urls) == 0 {
+			return
+		}
+
+		var batchResources []resourceMeta
+		for _, indexes := range batch {
+			batchResources = append(batchResources, metasOf(indexes)...)
 		}
 
 		batchBody, err := ac.getBatchResponseBody(urls)
 		if err != nil {
-			return nil, err
+			log.Printf("Failed to get resource info: %v", err)
+			status.failResources(batchResources, reasonLookup, err)
+			return
 		}
 
 		var batchData AzureBatchLookupResponse
 		err = json.Unmarshal(batchBody, &batchData)
 		if err != nil {
-			return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+			log.Printf("Failed to get resource info: Error unmarshalling response body: %v", err)
+			status.failResources(batchResources, reasonLookup, err)
+			return
 		}
 
-		for k, resp := range batchData.Responses {
-			updatedResources[i+k].resource = resp.Content
-			updatedResources[i+k].resource.Subscription = sc.C.Credentials.SubscriptionID
+		answered := make([]bool, len(batch))
+		for _, resp := range batchData.Responses {
+			k, ok := batchResponseIndex(resp.Name, len(batch))
+			if !ok || answered[k] {
+				log.Printf("Ignoring unexpected response %q in batch of %d lookups", resp.Name, len(batch))
+				continue
+			}
+			answered[k] = true
+
+			if !isSuccessStatus(resp.HttpStatusCode) {
+				lookupFailed(batch[k], resp.HttpStatusCode, resp.Content.APIError.Message)
+				continue
+			}
+			resource := resp.Content.AzureResource
+			resource.Subscription = resources[batch[k][0]].subscription
+			for _, index := range batch[k] {
+				updatedResources[index].resource = resource
+				found[index] = true
+			}
+			discoveries.set(lookupCacheKey(resource.Subscription, resources[batch[k][0]].resourceID), resource)
+		}
+		for k := range answered {
+			if !answered[k] {
+				lookupFailed(batch[k], 0, "no response in batch")
+			}
+		}
+	})
+
+	var foundResources []resourceMeta
+	for i, r := range updatedResources {
+		if found[i] {
+			foundResources = append(foundResources, r)
 		}
 	}
-	return updatedResources, nil
+	return foundResources
 }
 
 // Collect - collect results from Azure Montior API and create Prometheus metrics.
 func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 	if err := ac.refreshAccessToken(); err != nil {
-		log.Println(err)
+		authenticationFailed(err)
 		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
 		return
 	}
 
+	c.collectBlocks(ch, collectionBlocksFrom(sc.C))
+}
+
+// collectBlocks collects the metrics of the resources discovered by the given configuration blocks.
+// A failure only affects the block or batch it occurs in, and the success of each block is reported.
+// It returns the status of the collection.
+func (c *Collector) collectBlocks(ch chan<- prometheus.Metric, blocks []*collectionBlock) *scrapeStatus {
 	var resources []resourceMeta
 	var incompleteResources []resourceMeta
 
-	for _, target := range sc.C.Targets {
-		var rm resourceMeta
-
-		metrics := []string{}
-		for _, metric := range target.Metrics {
-			metrics = append(metrics, metric.Name)
-		}
-
-		rm.resourceID = target.Resource
-		rm.metrics = strings.Join(metrics, ",")
-		rm.aggregations = filterAggregations(target.Aggregations)
-		rm.resourceURL = resourceURLFrom(target.Resource, rm.metrics, rm.aggregations)
-		incompleteResources = append(incompleteResources, rm)
+	blocks = blocksByPriority(blocks)
+	names := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		names = append(names, b.name)
 	}
-
-	for _, resourceGroup := range sc.C.ResourceGroups {
-		metrics := []string{}
-		for _, metric := range resourceGroup.Metrics {
-			metrics = append(metrics, metric.Name)
+	status := newScrapeStatus(names...)
+	defer status.collect(ch)
+
+	// Blocks are discovered concurrently, their resources are kept in priority order
+	complete := make([][]resourceMeta, len(blocks))
+	incomplete := make([][]resourceMeta, len(blocks))
+	responses := newResponseCache()
+	forEachConcurrently(len(blocks), func(i int) {
+		b := blocks[i]
+		if skipForBudget(b) {
+			log.Printf("Skipping block %s to keep the remaining API budget for blocks of higher priority", b.name)
+			status.fail(b.name, reasonDiscovery, errBudgetExhausted)
+			return
 		}
-		metricsStr := strings.Join(metrics, ",")
 
-		filteredResources, err := ac.filteredListFromResourceGroup(resourceGroup)
+		var err error
+		complete[i], incomplete[i], err = discoverBlock(b, responses)
 		if err != nil {
-			log.Printf("Failed to get resources for resource group %s and resource types %s: %v",
-				resourceGroup.ResourceGroup, resourceGroup.ResourceTypes, err)
-			ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+			log.Printf("Failed to discover resources of block %s: %v", b.name, err)
+			status.fail(b.name, reasonDiscovery, err)
 			return
 		}
 
-		for _, f := range filteredResources {
-			var rm resourceMeta
-			rm.resourceID = f.ID
-			rm.metrics = metricsStr
-			rm.aggregations = filterAggregations(resourceGroup.Aggregations)
-			rm.resourceURL = resourceURLFrom(f.ID, rm.metrics, rm.aggregations)
-			rm.resource = f
-			resources = append(resources, rm)
-		}
+		discoveries.setDiscovered(b.name, countResources(complete[i])+countResources(incomplete[i]))
+	})
+	for i := range blocks {
+		resources = append(resources, complete[i]...)
+		incompleteResources = append(incompleteResources, incomplete[i]...)
 	}
 
-	resourcesCache := make(map[string][]byte)
-	for _, resourceTag := range sc.C.ResourceTags {
-		metrics := []string{}
-		for _, metric := range resourceTag.Metrics {
-			metrics = append(metrics, metric.Name)
+	// Resources found by queries are only known by ID until looked up
+	for _, rm := range c.batchLookupResources(incompleteResources, status) {
+		if rm.settings.filter != nil && !matchesFilter(rm.resource, *rm.settings.filter) {
+			continue
 		}
-		metricsStr := strings.Join(metrics, ",")
+		resources = append(resources, rm)
+	}
+	c.collectMetrics(ch, resources, status)
+	return status
+}
 
-		filteredResources, err := ac.filteredListByTag(resourceTag, resourcesCache)
-		if err != nil {
-			log.Printf("Failed to get resources for tag name %s, tag value %s: %v",
-				resourceTag.ResourceTagName, resourceTag.ResourceTagValue, err)
-			ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
-			return
-		}
+// ProbeCollector collects the metrics of a module for a single target resource or resource group.
+type ProbeCollector struct {
+	Collector
+	module        config.Module
+	subscription  string
+	resourceID    string
+	resourceGroup string
+}
 
-		for _, f := range filteredResources {
-			var rm resourceMeta
-			rm.resourceID = f.ID
-			rm.metrics = metricsStr
-			rm.aggregations = filterAggregations(resourceTag.Aggregations)
-			rm.resourceURL = resourceURLFrom(f.ID, rm.metrics, rm.aggregations)
-			incompleteResources = append(incompleteResources, rm)
-		}
+// Collect - collect results from Azure Montior API for the probed target and create Prometheus metrics.
+func (c *ProbeCollector) Collect(ch chan<- prometheus.Metric) {
+	if err := ac.refreshAccessToken(); err != nil {
+		authenticationFailed(err)
+		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+		return
+	}
+
+	status := newScrapeStatus("probe")
+	settings := &metricSettings{
+		block:          "probe",
+		metrics:        c.module.Metrics,
+		aggregations:   c.module.Aggregations,
+		window:         queryWindowFrom(c.module.Interval, c.module.Timespan, c.module.Delay),
+		labels:         c.module.Labels,
+		relabelConfigs: c.module.MetricRelabelConfigs,
+	}
+	if len(c.resourceGroup) == 0 {
+		incompleteResources := resourceMetasFrom(c.subscription, c.resourceID, settings)
+		resources := c.batchLookupResources(incompleteResources, status)
+		c.collectMetrics(ch, resources, status)
+		status.collect(ch)
+		return
 	}
 
-	completeResources, err := c.batchLookupResources(incompleteResources)
+	resourceGroup := config.ResourceGroup{
+		ResourceGroup:         c.resourceGroup,
+		ResourceTypes:         c.module.ResourceTypes,
+		ResourceNameIncludeRe: c.module.ResourceNameIncludeRe,
+		ResourceNameExcludeRe: c.module.ResourceNameExcludeRe,
+		Filter:                c.module.Filter,
+	}
+	filteredResources, err := ac.filteredListFromResourceGroup(c.subscription, resourceGroup)
 	if err != nil {
-		log.Printf("Failed to get resource info: %s", err)
-		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+		log.Printf("Failed to get resources for resource group %s and resource types %s in subscription %s: %v",
+			c.resourceGroup, c.module.ResourceTypes, c.subscription, err)
+		status.fail("probe", reasonDiscovery, err)
+		status.collect(ch)
 		return
 	}
 
-	resources = append(resources, completeResources...)
-	c.batchCollectMetrics(ch, resources)
+	var resources []resourceMeta
+	for _, f := range filteredResources {
+		for _, rm := range resourceMetasFrom(c.subscription, f.ID, settings) {
+			rm.resource = f
+			resources = append(resources, rm)
+		}
+	}
+	c.collectMetrics(ch, resources, status)
+	status.collect(ch)
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
 	registry := prometheus.NewRegistry()
-	collector := &Collector{}
+	if scheduler != nil {
+		// Serve the metrics collected in the background
+		registry.MustRegister(scheduler)
+	} else {
+		collector := &Collector{}
+		registry.MustRegister(collector)
+	}
+	registry.MustRegister(discoveries)
+	registry.MustRegister(remainingReadsGauge)
+	registry.MustRegister(scrapeErrors)
+	registry.MustRegister(batchItemErrors)
+	registry.MustRegister(tokenExpiryGauge)
+	if budget != nil {
+		registry.MustRegister(budget)
+	}
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	h.ServeHTTP(w, r)
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	moduleName := params.Get("module")
+	if moduleName == "" {
+		http.Error(w, "module parameter is missing", http.StatusBadRequest)
+		return
+	}
+	module, ok := sc.C.Modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	target := params.Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+	subscription, resourceID, resourceGroup, err := ParseProbeTarget(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(subscription) == 0 {
+		subscription = sc.C.Credentials.SubscriptionID
+	}
+	if len(subscription) == 0 {
+		http.Error(w, "target must start with /subscriptions/<subscription_id> when no subscription_id is configured", http.StatusBadRequest)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	collector := &ProbeCollector{
+		module:        module,
+		subscription:  subscription,
+		resourceID:    resourceID,
+		resourceGroup: resourceGroup,
+	}
 	registry.MustRegister(collector)
 	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	h.ServeHTTP(w, r)
@@ -310,10 +737,23 @@ func main() {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
-	err := ac.getAccessToken()
+	budget = newAPIBudget(sc.C.APIBudget)
+	requestSlots = make(chan struct{}, sc.C.MaxConcurrentRequests)
+
+	credentials, err := newCredentialProvider(sc.C.Credentials, ac.client)
+	if err != nil {
+		log.Fatalf("Error loading credentials: %v", err)
+	}
+	ac.setCredentials(credentials)
+
+	err = ac.refreshAccessToken()
 	if err != nil {
 		log.Fatalf("Failed to get token: %v", err)
 	}
+	go ac.tokens.renew(nil)
+	if usesDataPlane() {
+		go ac.metricsTokens.renew(nil)
+	}
 
 	// Print list of available metric definitions for each resource to console if specified.
 	if *listMetricDefinitions {
@@ -323,7 +763,7 @@ func main() {
 		}
 
 		for k, v := range results {
-			log.Printf("Resource: %s\n\nAvailable Metrics:\n", strings.Split(k, "/")[6])
+			log.Printf("Resource: %s\n\nAvailable Metrics:\n", strings.Split(k, "/")[8])
 			for _, r := range v.MetricDefinitionResponses {
 				log.Printf("- %s\n", r.Name.Value)
 			}
@@ -336,6 +776,12 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if sc.C.CollectionInterval != 0 {
+		log.Printf("Collecting metrics in the background every %v", sc.C.CollectionInterval)
+		scheduler = NewScheduler(sc.C)
+		go scheduler.Run()
+	}
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
             <head>
@@ -349,6 +795,7 @@ func main() {
 	})
 
 	http.HandleFunc("/metrics", handler)
+	http.HandleFunc("/probe", probeHandler)
 	log.Printf("azure_metrics_exporter listening on port %v", *listenAddress)
 	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
 		log.Fatalf("Error starting HTTP server: %v", err)
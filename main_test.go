@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+)
+
+func TestProbeHandler(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/batch"):
+			var batch batchBody
+			if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+				t.Error(err)
+				return
+			}
+			var responses []string
+			for _, req := range batch.Requests {
+				id := strings.Split(req.RelativeURL, "?")[0]
+				content := fmt.Sprintf(`{"id": %q}`, id)
+				if strings.Contains(id, "/microsoft.insights/metrics") {
+					content = `{"value": [{"name": {"value": "Percentage CPU"}, "unit": "Percent",
+						"timeseries": [{"data": [{"timeStamp": "2020-01-01T00:00:00Z", "average": 1}]}]}]}`
+				}
+				responses = append(responses, fmt.Sprintf(`{"name": %q, "httpStatusCode": 200, "content": %s}`, req.Name, content))
+			}
+			fmt.Fprintf(w, `{"responses": [%s]}`, strings.Join(responses, ","))
+		case strings.HasSuffix(r.URL.Path, "/resourceGroups/rg/resources"):
+			fmt.Fprint(w, `{"value": [
+				{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", "name": "vm1"},
+				{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2", "name": "vm2"}
+			]}`)
+		default:
+			// No metric definitions
+			fmt.Fprint(w, `{"value": []}`)
+		}
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{
+		ResourceManagerURL: server.URL,
+		Credentials:        config.Credentials{SubscriptionID: "sub"},
+		Modules: map[string]config.Module{
+			"vm": {
+				ResourceTypes:         []string{"Microsoft.Compute/virtualMachines"},
+				ResourceNameExcludeRe: []config.Regexp{{Regexp: regexp.MustCompile("^vm2$")}},
+				Metrics:               []config.Metric{{Name: "Percentage CPU"}},
+			},
+		},
+	}
+	defer func() { sc.C = previous }()
+	previousVersions := ac.APIVersions
+	ac.APIVersions = APIVersionMap{"Microsoft.Compute/virtualMachines": "2019-07-01"}
+	defer func() { ac.APIVersions = previousVersions }()
+
+	var cases = []struct {
+		query      string
+		statusCode int
+		contains   []string
+		excludes   []string
+	}{
+		{"target=rg", http.StatusBadRequest, []string{"module parameter is missing"}, nil},
+		{"module=unknown&target=rg", http.StatusBadRequest, []string{`Unknown module "unknown"`}, nil},
+		{"module=vm", http.StatusBadRequest, []string{"target parameter is missing"}, nil},
+		{"module=vm&target=rg/vm1", http.StatusBadRequest, nil, nil},
+		{
+			"module=vm&target=/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1",
+			http.StatusOK,
+			[]string{`percentage_cpu_percent_average{azure_subscription="sub",resource_group="rg",resource_name="vm1"} 1`, `azure_scrape_success{block="probe"} 1`},
+			nil,
+		},
+		{
+			"module=vm&target=/resourceGroups/rg",
+			http.StatusOK,
+			[]string{`percentage_cpu_percent_average{azure_subscription="sub",resource_group="rg",resource_name="vm1"} 1`, `azure_scrape_success{block="probe"} 1`},
+			[]string{`resource_name="vm2"`},
+		},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		probeHandler(w, httptest.NewRequest("GET", "/probe?"+c.query, nil))
+
+		body := w.Body.String()
+		if w.Code != c.statusCode {
+			t.Errorf("unexpected status code for %s\ngot: %d\nwant: %d\n%s", c.query, w.Code, c.statusCode, body)
+			continue
+		}
+		for _, s := range c.contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("doesn't probe %s as expected\ngot: %s\nwant: %s", c.query, body, s)
+			}
+		}
+		for _, s := range c.excludes {
+			if strings.Contains(body, s) {
+				t.Errorf("doesn't apply the module filters probing %s\ngot: %s", c.query, body)
+			}
+		}
+	}
+}
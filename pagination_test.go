@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+)
+
+// newFakeARMServer serves the given pages of values for each path, linking them with nextLink.
+func newFakeARMServer(pages map[string][]string) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		values, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		nextLink := ""
+		if page+1 < len(values) {
+			nextLink = fmt.Sprintf(`, "nextLink": "%s%s?api-version=x&page=%d"`, server.URL, r.URL.Path, page+1)
+		}
+		fmt.Fprintf(w, `{"value": [%s]%s}`, values[page], nextLink)
+	}))
+	return server
+}
+
+func withFakeARMServer(pages map[string][]string) func() {
+	server := newFakeARMServer(pages)
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL, Credentials: config.Credentials{SubscriptionID: "sub"}}
+	return func() {
+		sc.C = previous
+		server.Close()
+	}
+}
+
+func resourceNames(resources []AzureResource) []string {
+	var names []string
+	for _, r := range resources {
+		names = append(names, r.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestListFromResourceGroupPagination(t *testing.T) {
+	defer withFakeARMServer(map[string][]string{
+		"/subscriptions/sub/resourceGroups/rg/resources": {
+			`{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", "name": "vm1"}`,
+			`{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2", "name": "vm2"}`,
+			`{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm3", "name": "vm3"}`,
+		},
+	})()
+
+	resources, err := ac.listFromResourceGroup("sub", "rg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"vm1", "vm2", "vm3"}
+	if got := resourceNames(resources); !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't list resources of all pages\ngot: %v\nwant: %v", got, want)
+	}
+	if resources[0].ID != "/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1" {
+		t.Errorf("doesn't strip subscription from resource id\ngot: %v", resources[0].ID)
+	}
+}
+
+func TestListByTagPagination(t *testing.T) {
+	defer withFakeARMServer(map[string][]string{
+		"/subscriptions/sub/resources": {
+			`{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", "name": "vm1", "type": "Microsoft.Compute/virtualMachines"}`,
+			`{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Sql/servers/sql1", "name": "sql1", "type": "Microsoft.Sql/servers"},
+			 {"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2", "name": "vm2", "type": "Microsoft.Compute/virtualMachines"}`,
+		},
+	})()
+
+	resources, err := ac.listByTag("sub", "env", "prod", []string{"Microsoft.Compute/virtualMachines"}, newResponseCache())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"vm1", "vm2"}
+	if got := resourceNames(resources); !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't list resources of all pages\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestListSubscriptionsPagination(t *testing.T) {
+	defer withFakeARMServer(map[string][]string{
+		"/subscriptions": {
+			`{"subscriptionId": "sub1", "state": "Enabled"}, {"subscriptionId": "sub2", "state": "Disabled"}`,
+			`{"subscriptionId": "sub3", "state": "Enabled"}`,
+		},
+	})()
+
+	subscriptions, err := ac.listSubscriptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"sub1", "sub3"}
+	if !reflect.DeepEqual(subscriptions, want) {
+		t.Errorf("doesn't list subscriptions of all pages\ngot: %v\nwant: %v", subscriptions, want)
+	}
+}
+
+func TestListAPIVersionsPagination(t *testing.T) {
+	defer withFakeARMServer(map[string][]string{
+		"/subscriptions/sub/providers": {
+			`{"namespace": "Microsoft.Compute", "resourceTypes": [{"resourceType": "virtualMachines", "apiVersions": ["2019-03-01", "2018-06-01"]}]}`,
+			`{"namespace": "Microsoft.Sql", "resourceTypes": [{"resourceType": "servers", "apiVersions": ["2014-04-01", "2015-05-01"]}]}`,
+		},
+	})()
+	previous := ac.APIVersions
+	defer func() { ac.APIVersions = previous }()
+
+	if err := ac.listAPIVersions(); err != nil {
+		t.Fatal(err)
+	}
+
+	for resourceType, want := range map[string]string{"Microsoft.Compute/virtualMachines": "2019-03-01", "Microsoft.Sql/servers": "2015-05-01"} {
+		if got := ac.APIVersions.findBy(resourceType); got != want {
+			t.Errorf("doesn't find API version of %s\ngot: %v\nwant: %v", resourceType, got, want)
+		}
+	}
+}
+
+func TestQueryResourcesPagination(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/providers/Microsoft.ResourceGraph/resources" {
+			// No metric definitions
+			fmt.Fprint(w, `{"value": []}`)
+			return
+		}
+
+		var request resourceGraphRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+			return
+		}
+		if request.Query != "resources | where type =~ 'microsoft.compute/virtualmachines'" || !reflect.DeepEqual(request.Subscriptions, []string{"sub"}) {
+			t.Errorf("doesn't send the query over the subscriptions\ngot: %v", request)
+		}
+
+		switch request.Options.SkipToken {
+		case "":
+			fmt.Fprint(w, `{"data": [
+				{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", "env": "prod"},
+				{"name": "row without id"}
+			], "$skipToken": "page2"}`)
+		case "page2":
+			fmt.Fprint(w, `{"data": [{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2", "env": "dev"}]}`)
+		default:
+			t.Errorf("unexpected skip token %q", request.Options.SkipToken)
+		}
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL, Credentials: config.Credentials{SubscriptionID: "sub"}}
+	defer func() { sc.C = previous }()
+
+	resources, err := discoverResourceQuery("resource_queries[0]", config.ResourceQuery{
+		Query:   "resources | where type =~ 'microsoft.compute/virtualmachines'",
+		Metrics: []config.Metric{{Name: "Percentage CPU"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, rm := range resources {
+		got = append(got, rm.resourceID+" "+rm.labels["env"])
+	}
+	want := []string{
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1 prod",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2 dev",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't discover the resources of all pages, skipping rows without id\ngot: %v\nwant: %v", got, want)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import "sync"
+
+// requestSlots bounds the number of requests to Azure in flight at once, shared by discovery, lookups and
+// metric batches. A nil channel does not limit requests.
+var requestSlots chan struct{}
+
+// Returns the limit of requests to Azure in flight at once
+func maxConcurrentRequests() int {
+	if sc.C == nil || sc.C.MaxConcurrentRequests < 1 {
+		return 1
+	}
+	return sc.C.MaxConcurrentRequests
+}
+
+// Waits for a request slot to be free and takes it
+func acquireRequestSlot() {
+	if requestSlots != nil {
+		requestSlots <- struct{}{}
+	}
+}
+
+// Frees a request slot taken by acquireRequestSlot
+func releaseRequestSlot() {
+	if requestSlots != nil {
+		<-requestSlots
+	}
+}
+
+// forEachConcurrently calls fn for each index from 0 to n-1 from a pool of at most maxConcurrentRequests
+// workers, and returns once all calls have returned.
+func forEachConcurrently(n int, fn func(i int)) {
+	workers := maxConcurrentRequests()
+	if workers > n {
+		workers = n
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+)
+
+func TestForEachConcurrently(t *testing.T) {
+	previous := sc.C
+	sc.C = &config.Config{MaxConcurrentRequests: 3}
+	defer func() { sc.C = previous }()
+
+	var mtx sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	calls := make([]int, 20)
+	forEachConcurrently(len(calls), func(i int) {
+		mtx.Lock()
+		calls[i]++
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mtx.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mtx.Lock()
+		inFlight--
+		mtx.Unlock()
+	})
+
+	for i, n := range calls {
+		if n != 1 {
+			t.Errorf("doesn't call fn once per index\ngot: %d calls for index %d\nwant: %d", n, i, 1)
+		}
+	}
+	if maxInFlight > 3 {
+		t.Errorf("doesn't bound the number of workers\ngot: %d\nwant: at most %d", maxInFlight, 3)
+	}
+}
+
+func TestBatchLookupResourcesConcurrently(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch batchBody
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Error(err)
+			return
+		}
+
+		// Batches complete out of order
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+
+		// Responses come back in reverse order, matched to their requests by name
+		var responses []string
+		for i := len(batch.Requests) - 1; i >= 0; i-- {
+			req := batch.Requests[i]
+			id := strings.Split(req.RelativeURL, "?")[0]
+			responses = append(responses, fmt.Sprintf(`{"name": %q, "httpStatusCode": 200, "content": {"id": %q}}`, req.Name, id))
+		}
+		fmt.Fprintf(w, `{"responses": [%s]}`, strings.Join(responses, ","))
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL, MaxConcurrentRequests: 4}
+	defer func() { sc.C = previous }()
+	previousVersions := ac.APIVersions
+	ac.APIVersions = APIVersionMap{"Microsoft.Compute/virtualMachines": "2019-07-01"}
+	defer func() { ac.APIVersions = previousVersions }()
+
+	settings := &metricSettings{block: "targets[0]"}
+	var resources []resourceMeta
+	for i := 0; i < 5*batchSize; i++ {
+		id := fmt.Sprintf("/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm%d", i)
+		resources = append(resources, resourceMeta{
+			resourceID:   id,
+			subscription: "sub",
+			resourceURL:  "/subscriptions/sub" + id,
+			settings:     settings,
+		})
+	}
+
+	status := newScrapeStatus(settings.block)
+	found := (&Collector{}).batchLookupResources(resources, status)
+
+	if len(found) != len(resources) {
+		t.Fatalf("doesn't look up every resource\ngot: %d\nwant: %d", len(found), len(resources))
+	}
+	for _, rm := range found {
+		if !strings.HasSuffix(rm.resource.ID, rm.resourceID) {
+			t.Errorf("doesn't match responses to their resources\ngot: %s\nwant: %s", rm.resource.ID, rm.resourceID)
+		}
+	}
+}
+
+func TestBatchLookupResourcesOncePerResource(t *testing.T) {
+	var mtx sync.Mutex
+	lookups := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch batchBody
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Error(err)
+			return
+		}
+
+		var responses []string
+		for _, req := range batch.Requests {
+			id := strings.Split(req.RelativeURL, "?")[0]
+			mtx.Lock()
+			lookups[id]++
+			mtx.Unlock()
+			responses = append(responses, fmt.Sprintf(`{"name": %q, "httpStatusCode": 200, "content": {"id": %q}}`, req.Name, id))
+		}
+		fmt.Fprintf(w, `{"responses": [%s]}`, strings.Join(responses, ","))
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL}
+	defer func() { sc.C = previous }()
+	previousVersions := ac.APIVersions
+	ac.APIVersions = APIVersionMap{"Microsoft.Compute/virtualMachines": "2019-07-01"}
+	defer func() { ac.APIVersions = previousVersions }()
+
+	// Each resource is collected by two metas of a block, and by another block
+	var resources []resourceMeta
+	for _, block := range []string{"targets[0]", "targets[0]", "targets[1]"} {
+		settings := &metricSettings{block: block}
+		for i := 0; i < 2; i++ {
+			id := fmt.Sprintf("/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/lookup%d", i)
+			resources = append(resources, resourceMeta{resourceID: id, subscription: "sub", resourceURL: "/subscriptions/sub" + id, settings: settings})
+		}
+	}
+
+	found := (&Collector{}).batchLookupResources(resources, newScrapeStatus("targets[0]", "targets[1]"))
+
+	if len(found) != len(resources) {
+		t.Fatalf("doesn't return every meta of the resources\ngot: %d\nwant: %d", len(found), len(resources))
+	}
+	for _, rm := range found {
+		if !strings.HasSuffix(rm.resource.ID, rm.resourceID) {
+			t.Errorf("doesn't copy the resource to each of its metas\ngot: %s\nwant: %s", rm.resource.ID, rm.resourceID)
+		}
+	}
+	for id, n := range lookups {
+		if n != 1 {
+			t.Errorf("doesn't look up resources once\ngot: %d lookups of %s\nwant: %d", n, id, 1)
+		}
+	}
+	if len(lookups) != 2 {
+		t.Errorf("doesn't look up every resource\ngot: %v", lookups)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/common/model"
+)
+
+// metricSettings holds the settings of a configuration block applying to the metrics of its resources
+type metricSettings struct {
+	block          string
+	metrics        []config.Metric
+	aggregations   []string
+	window         queryWindow
+	labels         map[string]string
+	relabelConfigs []config.RelabelConfig
+
+	// Filter applied once resources are looked up, for blocks discovering resources by ID only
+	filter *config.ResourceFilter
+}
+
+// Returns the configuration of the given Azure metric, if any
+func (s *metricSettings) metricConfigOf(metricName string) config.Metric {
+	for _, metric := range s.metrics {
+		if strings.EqualFold(metric.Name, metricName) {
+			return metric
+		}
+	}
+	return config.Metric{}
+}
+
+// applyLabels adds the static labels of the block and metric to the labels of a series, and applies
+// the relabeling rules of the metric and then of the block. It returns the resulting metric name and labels,
+// or false if the series is dropped.
+func (s *metricSettings) applyLabels(metricName string, labels map[string]string, metric config.Metric) (string, map[string]string, bool) {
+	result := make(map[string]string, len(labels)+len(s.labels)+len(metric.Labels)+1)
+	for k, v := range labels {
+		result[k] = v
+	}
+	for k, v := range s.labels {
+		result[k] = v
+	}
+	for k, v := range metric.Labels {
+		result[k] = v
+	}
+	result[model.MetricNameLabel] = metricName
+
+	result = relabel(result, metric.MetricRelabelConfigs)
+	if result == nil {
+		return "", nil, false
+	}
+	result = relabel(result, s.relabelConfigs)
+	if result == nil {
+		return "", nil, false
+	}
+
+	name := result[model.MetricNameLabel]
+	if !config.ValidMetricName.MatchString(name) {
+		return "", nil, false
+	}
+	for k := range result {
+		if strings.HasPrefix(k, model.ReservedLabelPrefix) {
+			delete(result, k)
+		}
+	}
+	return name, result, true
+}
+
+// relabel applies relabeling rules to the labels of a series, the metric name being the __name__ label.
+// It returns nil if the series is dropped.
+func relabel(labels map[string]string, cfgs []config.RelabelConfig) map[string]string {
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[k] = v
+	}
+
+	for _, cfg := range cfgs {
+		values := make([]string, 0, len(cfg.SourceLabels))
+		for _, name := range cfg.SourceLabels {
+			values = append(values, result[name])
+		}
+		value := strings.Join(values, cfg.Separator)
+
+		switch cfg.Action {
+		case config.RelabelKeep:
+			if !cfg.Regex.MatchString(value) {
+				return nil
+			}
+		case config.RelabelDrop:
+			if cfg.Regex.MatchString(value) {
+				return nil
+			}
+		case config.RelabelReplace:
+			indexes := cfg.Regex.FindStringSubmatchIndex(value)
+			if indexes == nil {
+				break
+			}
+			target := string(cfg.Regex.ExpandString([]byte{}, cfg.TargetLabel, value, indexes))
+			if !config.ValidLabelName.MatchString(target) {
+				break
+			}
+			replacement := string(cfg.Regex.ExpandString([]byte{}, cfg.Replacement, value, indexes))
+			if len(replacement) == 0 {
+				delete(result, target)
+				break
+			}
+			result[target] = replacement
+		case config.RelabelLabelMap:
+			mapped := make(map[string]string)
+			for name, v := range result {
+				if !cfg.Regex.MatchString(name) {
+					continue
+				}
+				target := cfg.Regex.ReplaceAllString(name, cfg.Replacement)
+				if !config.ValidLabelName.MatchString(target) {
+					continue
+				}
+				mapped[target] = v
+			}
+			for name, v := range mapped {
+				result[name] = v
+			}
+		case config.RelabelLabelDrop:
+			for name := range result {
+				if cfg.Regex.MatchString(name) {
+					delete(result, name)
+				}
+			}
+		case config.RelabelLabelKeep:
+			for name := range result {
+				if !cfg.Regex.MatchString(name) {
+					delete(result, name)
+				}
+			}
+		}
+	}
+	return result
+}
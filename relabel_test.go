@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+)
+
+func TestRelabel(t *testing.T) {
+	newRegexp := func(s string) config.Regexp {
+		return config.Regexp{Regexp: regexp.MustCompile("^(?:" + s + ")$")}
+	}
+	labels := map[string]string{"__name__": "percentage_cpu_percent_average", "resource_group": "prod-rg-001", "resource_name": "prod-vm-01"}
+
+	var cases = []struct {
+		cfgs []config.RelabelConfig
+		want map[string]string
+	}{
+		{
+			[]config.RelabelConfig{{SourceLabels: []string{"resource_group"}, Separator: ";", Regex: newRegexp("prod-.*"), Action: config.RelabelKeep}},
+			labels,
+		},
+		{
+			[]config.RelabelConfig{{SourceLabels: []string{"resource_group"}, Separator: ";", Regex: newRegexp("prod-.*"), Action: config.RelabelDrop}},
+			nil,
+		},
+		{
+			[]config.RelabelConfig{{SourceLabels: []string{"resource_group", "resource_name"}, Separator: "/", Regex: newRegexp("prod-(.*)"),
+				TargetLabel: "id", Replacement: "$1", Action: config.RelabelReplace}},
+			map[string]string{"__name__": "percentage_cpu_percent_average", "resource_group": "prod-rg-001", "resource_name": "prod-vm-01", "id": "rg-001/prod-vm-01"},
+		},
+		{
+			[]config.RelabelConfig{{SourceLabels: []string{"__name__"}, Separator: ";", Regex: newRegexp("percentage_cpu_(.*)"),
+				TargetLabel: "__name__", Replacement: "vm_cpu_$1", Action: config.RelabelReplace}},
+			map[string]string{"__name__": "vm_cpu_percent_average", "resource_group": "prod-rg-001", "resource_name": "prod-vm-01"},
+		},
+		{
+			[]config.RelabelConfig{{Regex: newRegexp("resource_(.*)"), Replacement: "azure_$1", Action: config.RelabelLabelMap}},
+			map[string]string{"__name__": "percentage_cpu_percent_average", "resource_group": "prod-rg-001", "resource_name": "prod-vm-01",
+				"azure_group": "prod-rg-001", "azure_name": "prod-vm-01"},
+		},
+		{
+			[]config.RelabelConfig{{Regex: newRegexp("resource_(.*)"), Replacement: "tag-$1", Action: config.RelabelLabelMap}},
+			labels,
+		},
+		{
+			[]config.RelabelConfig{{Regex: newRegexp("resource_group"), Action: config.RelabelLabelDrop}},
+			map[string]string{"__name__": "percentage_cpu_percent_average", "resource_name": "prod-vm-01"},
+		},
+		{
+			[]config.RelabelConfig{{Regex: newRegexp("__name__|resource_name"), Action: config.RelabelLabelKeep}},
+			map[string]string{"__name__": "percentage_cpu_percent_average", "resource_name": "prod-vm-01"},
+		},
+	}
+
+	for _, c := range cases {
+		got := relabel(labels, c.cfgs)
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("doesn't relabel as expected\ngot: %v\nwant: %v", got, c.want)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	snapshotAgeDesc = prometheus.NewDesc(
+		"azure_snapshot_age_seconds",
+		"Age of the last snapshot of metrics collected in the background for the configuration block",
+		[]string{"block"}, nil,
+	)
+	snapshotRefreshDurationDesc = prometheus.NewDesc(
+		"azure_snapshot_refresh_duration_seconds",
+		"Duration of the last background refresh of metrics for the configuration block",
+		[]string{"block"}, nil,
+	)
+)
+
+// collectionBlock is a configuration block refreshed on its own interval.
+type collectionBlock struct {
+	name            string
+	interval        time.Duration
+	priority        int
+	targets         []config.Target
+	resourceGroups  []config.ResourceGroup
+	resourceTags    []config.ResourceTag
+	resourceQueries []config.ResourceQuery
+	resourceTypes   []config.ResourceType
+	nextRefresh     time.Time
+}
+
+// snapshot holds the metrics collected during the last refresh of a block.
+type snapshot struct {
+	metrics   []prometheus.Metric
+	updatedAt time.Time
+	duration  time.Duration
+}
+
+// Scheduler refreshes the metrics of each configuration block in the background
+// and serves the last snapshots as a prometheus.Collector.
+type Scheduler struct {
+	mtx       sync.RWMutex
+	blocks    []*collectionBlock
+	snapshots map[string]snapshot
+}
+
+// NewScheduler returns a Scheduler for each discovery block of the given configuration.
+func NewScheduler(c *config.Config) *Scheduler {
+	return &Scheduler{
+		blocks:    blocksByPriority(collectionBlocksFrom(c)),
+		snapshots: make(map[string]snapshot),
+	}
+}
+
+// collectionBlocksFrom returns a collection block for each discovery block of the given configuration.
+func collectionBlocksFrom(c *config.Config) []*collectionBlock {
+	var blocks []*collectionBlock
+	for i, t := range c.Targets {
+		blocks = append(blocks, &collectionBlock{
+			name:     fmt.Sprintf("targets[%d]", i),
+			interval: blockInterval(c, t.CollectionInterval),
+			priority: t.Priority,
+			targets:  c.Targets[i : i+1],
+		})
+	}
+	for i, g := range c.ResourceGroups {
+		blocks = append(blocks, &collectionBlock{
+			name:           fmt.Sprintf("resource_groups[%d]", i),
+			interval:       blockInterval(c, g.CollectionInterval),
+			priority:       g.Priority,
+			resourceGroups: c.ResourceGroups[i : i+1],
+		})
+	}
+	for i, t := range c.ResourceTags {
+		blocks = append(blocks, &collectionBlock{
+			name:         fmt.Sprintf("resource_tags[%d]", i),
+			interval:     blockInterval(c, t.CollectionInterval),
+			priority:     t.Priority,
+			resourceTags: c.ResourceTags[i : i+1],
+		})
+	}
+	for i, q := range c.ResourceQueries {
+		blocks = append(blocks, &collectionBlock{
+			name:            fmt.Sprintf("resource_queries[%d]", i),
+			interval:        blockInterval(c, q.CollectionInterval),
+			priority:        q.Priority,
+			resourceQueries: c.ResourceQueries[i : i+1],
+		})
+	}
+	for i, t := range c.ResourceTypes {
+		blocks = append(blocks, &collectionBlock{
+			name:          fmt.Sprintf("resource_types[%d]", i),
+			interval:      blockInterval(c, t.CollectionInterval),
+			priority:      t.Priority,
+			resourceTypes: c.ResourceTypes[i : i+1],
+		})
+	}
+	return blocks
+}
+
+// blocksByPriority returns the blocks sorted by decreasing priority, keeping the configuration order otherwise.
+func blocksByPriority(blocks []*collectionBlock) []*collectionBlock {
+	sorted := make([]*collectionBlock, len(blocks))
+	copy(sorted, blocks)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].priority > sorted[j].priority
+	})
+	return sorted
+}
+
+func blockInterval(c *config.Config, interval model.Duration) time.Duration {
+	if interval != 0 {
+		return time.Duration(interval)
+	}
+	return time.Duration(c.CollectionInterval)
+}
+
+// Run refreshes the blocks when they are due, forever. Blocks are refreshed one at a time, each refresh sending
+// its requests through the worker pool, bounded by requestSlots. The Azure client is safe for concurrent use
+// by refreshes and scrapes: its caches are guarded by mutexes and tokens are shared through the token source.
+func (s *Scheduler) Run() {
+	if len(s.blocks) == 0 {
+		return
+	}
+
+	for {
+		for _, b := range s.blocks {
+			if time.Now().Before(b.nextRefresh) {
+				continue
+			}
+			b.nextRefresh = time.Now().Add(b.interval)
+			s.refresh(b)
+		}
+
+		next := s.blocks[0].nextRefresh
+		for _, b := range s.blocks[1:] {
+			if b.nextRefresh.Before(next) {
+				next = b.nextRefresh
+			}
+		}
+		time.Sleep(time.Until(next))
+	}
+}
+
+// refresh collects the metrics of a block and replaces its snapshot.
+func (s *Scheduler) refresh(b *collectionBlock) {
+	if (onBudgetExhausted(config.BudgetServeStale) && budget.isExhausted()) || skipForBudget(b) {
+		log.Printf("Keeping last snapshot of block %s: %v", b.name, errBudgetExhausted)
+		return
+	}
+
+	// An authentication failure keeps the last snapshot, as an invalid metric in it would fail every scrape
+	if err := ac.refreshAccessToken(); err != nil {
+		authenticationFailed(err)
+		log.Printf("Keeping last snapshot of block %s: %v", b.name, err)
+		return
+	}
+
+	start := time.Now()
+	ch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+
+	go func() {
+		var metrics []prometheus.Metric
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		done <- metrics
+	}()
+
+	c := &Collector{}
+	status := c.collectBlocks(ch, []*collectionBlock{b})
+	close(ch)
+	metrics := <-done
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// The budget may run out partway through, leaving partial metrics which must not replace the last snapshot
+	if _, ok := s.snapshots[b.name]; ok && status.exhaustedBudget() && onBudgetExhausted(config.BudgetServeStale) {
+		log.Printf("Keeping last snapshot of block %s: %v", b.name, errBudgetExhausted)
+		return
+	}
+	s.snapshots[b.name] = snapshot{
+		metrics:   metrics,
+		updatedAt: time.Now(),
+		duration:  time.Since(start),
+	}
+}
+
+// Describe implemented with dummy data to satisfy interface.
+func (s *Scheduler) Describe(ch chan<- *prometheus.Desc) {
+	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
+}
+
+// Collect - serve the metrics of the last snapshot of each block.
+func (s *Scheduler) Collect(ch chan<- prometheus.Metric) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	// A resource found in several blocks has its azure_resource_info in each snapshot, only send it once
+	seen := make(map[string]bool)
+	for name, snap := range s.snapshots {
+		for _, m := range snap.metrics {
+			key := metricKey(m)
+			if key != "" {
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+			}
+			ch <- m
+		}
+
+		ch <- prometheus.MustNewConstMetric(snapshotAgeDesc, prometheus.GaugeValue, time.Since(snap.updatedAt).Seconds(), name)
+		ch <- prometheus.MustNewConstMetric(snapshotRefreshDurationDesc, prometheus.GaugeValue, snap.duration.Seconds(), name)
+	}
+}
+
+// metricKey returns a key identifying a metric by its name and label values, or "" for invalid metrics.
+func metricKey(m prometheus.Metric) string {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		return ""
+	}
+
+	var labels []string
+	for _, lp := range pb.Label {
+		labels = append(labels, lp.GetName()+"="+lp.GetValue())
+	}
+	sort.Strings(labels)
+	return m.Desc().String() + strings.Join(labels, ",")
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSchedulerCollect(t *testing.T) {
+	infoLabels := map[string]string{"resource_group": "prod-rg-001", "resource_name": "prod-vm-01"}
+	info := prometheus.MustNewConstMetric(
+		prometheus.NewDesc("azure_resource_info", "Azure information available for resource", nil, infoLabels),
+		prometheus.GaugeValue,
+		1,
+	)
+	cpu := prometheus.MustNewConstMetric(
+		prometheus.NewDesc("percentage_cpu_percent_average", "percentage_cpu_percent_average", nil, infoLabels),
+		prometheus.GaugeValue,
+		42,
+	)
+	credits := prometheus.MustNewConstMetric(
+		prometheus.NewDesc("cpu_credits_consumed_count_total", "cpu_credits_consumed_count_total", nil, infoLabels),
+		prometheus.GaugeValue,
+		3,
+	)
+
+	s := &Scheduler{snapshots: map[string]snapshot{
+		"resource_groups[0]": {metrics: []prometheus.Metric{cpu, info}, updatedAt: time.Now()},
+		"resource_tags[0]":   {metrics: []prometheus.Metric{credits, info}, updatedAt: time.Now()},
+	}}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		s.Collect(ch)
+		close(ch)
+	}()
+
+	counts := make(map[string]int)
+	for m := range ch {
+		counts[m.Desc().String()]++
+	}
+
+	// 3 distinct metrics, plus the age and refresh duration of both snapshots
+	if len(counts) != 5 {
+		t.Errorf("unexpected number of distinct metrics\ngot: %d\nwant: %d", len(counts), 5)
+	}
+	if got := counts[info.Desc().String()]; got != 1 {
+		t.Errorf("azure_resource_info should be sent once\ngot: %d", got)
+	}
+	if got := counts[snapshotAgeDesc.String()]; got != 2 {
+		t.Errorf("azure_snapshot_age_seconds should be sent for each snapshot\ngot: %d", got)
+	}
+}
+
+func TestSchedulerRefreshKeepsSnapshotWhenBudgetRunsOut(t *testing.T) {
+	batches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/batch"):
+			batches++
+			fmt.Fprint(w, `{"responses": []}`)
+		case strings.HasSuffix(r.URL.Path, "/resources"):
+			fmt.Fprint(w, `{"value": [
+				{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm1", "name": "vm1"},
+				{"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2", "name": "vm2"}
+			]}`)
+		default:
+			// No metric definitions
+			fmt.Fprint(w, `{"value": []}`)
+		}
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{
+		ResourceManagerURL: server.URL,
+		Credentials:        config.Credentials{SubscriptionID: "sub"},
+		APIBudget:          config.APIBudget{OnExhausted: config.BudgetServeStale},
+		ResourceGroups: []config.ResourceGroup{{
+			ResourceGroup: "rg",
+			ResourceTypes: []string{"Microsoft.Compute/virtualMachines"},
+			Metrics:       []config.Metric{{Name: "Percentage CPU"}},
+		}},
+	}
+	defer func() { sc.C = previous }()
+
+	// Enough budget to list the resources and get their metric definitions, not to query the batch of both
+	previousBudget := budget
+	budget = &apiBudget{burst: 2, tokens: 2, last: time.Now()}
+	defer func() { budget = previousBudget }()
+
+	b := collectionBlocksFrom(sc.C)[0]
+	last := snapshot{updatedAt: time.Now().Add(-time.Hour)}
+	s := &Scheduler{snapshots: map[string]snapshot{b.name: last}}
+	s.refresh(b)
+
+	if batches != 0 {
+		t.Fatalf("doesn't run out of budget before the batch\ngot: %d batches", batches)
+	}
+	if got := s.snapshots[b.name]; !got.updatedAt.Equal(last.updatedAt) {
+		t.Errorf("doesn't keep the last snapshot when the budget runs out partway through\ngot: updated at %v\nwant: %v", got.updatedAt, last.updatedAt)
+	}
+}
+
+// failingCredential never gets a token
+type failingCredential struct{}
+
+func (failingCredential) getToken(resource string) (accessToken, error) {
+	return accessToken{}, fmt.Errorf("AADSTS50058: temporarily unavailable")
+}
+
+func TestSchedulerRefreshKeepsSnapshotWhenAuthenticationFails(t *testing.T) {
+	previous := sc.C
+	sc.C = &config.Config{
+		Credentials: config.Credentials{SubscriptionID: "sub"},
+		ResourceGroups: []config.ResourceGroup{{
+			ResourceGroup: "rg",
+			Metrics:       []config.Metric{{Name: "Percentage CPU"}},
+		}},
+	}
+	defer func() { sc.C = previous }()
+	previousTokens := ac.tokens
+	ac.tokens = newTokenSource(failingCredential{}, "https://management.azure.com/")
+	defer func() { ac.tokens = previousTokens }()
+
+	b := collectionBlocksFrom(sc.C)[0]
+	cpu := prometheus.MustNewConstMetric(
+		prometheus.NewDesc("percentage_cpu_percent_average", "Percentage CPU", nil, nil),
+		prometheus.GaugeValue, 42,
+	)
+	last := snapshot{metrics: []prometheus.Metric{cpu}, updatedAt: time.Now().Add(-time.Hour)}
+	s := &Scheduler{snapshots: map[string]snapshot{b.name: last}}
+	s.refresh(b)
+
+	got := s.snapshots[b.name]
+	if !got.updatedAt.Equal(last.updatedAt) || len(got.metrics) != 1 || got.metrics[0] != cpu {
+		t.Errorf("doesn't keep the last snapshot when authentication fails\ngot: %v\nwant: %v", got.metrics, last.metrics)
+	}
+
+	// Without a previous snapshot, nothing is stored rather than an invalid metric failing every scrape
+	s = &Scheduler{snapshots: map[string]snapshot{}}
+	s.refresh(b)
+	if _, ok := s.snapshots[b.name]; ok {
+		t.Errorf("stores a snapshot when authentication fails")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reasons of scrape errors
+const (
+	reasonAuthentication  = "authentication"
+	reasonDiscovery       = "discovery"
+	reasonLookup          = "lookup"
+	reasonBatch           = "batch"
+	reasonBudgetExhausted = "budget_exhausted"
+)
+
+var (
+	scrapeSuccessDesc = prometheus.NewDesc(
+		"azure_scrape_success",
+		"Whether the last collection of the configuration block succeeded",
+		[]string{"block"}, nil,
+	)
+	scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "azure_scrape_errors_total",
+		Help: "Number of errors collecting metrics from Azure, by reason",
+	}, []string{"reason"})
+	batchItemErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "azure_batch_item_errors_total",
+		Help: "Number of requests inside batches which failed, by configuration block and status code (none when missing from the batch response)",
+	}, []string{"block", "status_code"})
+)
+
+// scrapeStatus records which configuration blocks failed during a collection, so that failures
+// are isolated to the blocks and batches they occurred in.
+type scrapeStatus struct {
+	mtx    sync.Mutex
+	blocks []string
+	failed map[string]bool
+	// Whether a request was refused because the API budget was exhausted
+	budgetExhausted bool
+}
+
+func newScrapeStatus(blocks ...string) *scrapeStatus {
+	return &scrapeStatus{blocks: blocks, failed: make(map[string]bool)}
+}
+
+// fail marks a block as failed and counts the error.
+func (s *scrapeStatus) fail(block string, reason string, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.failed[block] = true
+	s.budgetExhausted = s.budgetExhausted || err == errBudgetExhausted
+	scrapeErrors.WithLabelValues(reasonFor(reason, err)).Inc()
+}
+
+// failResources marks the blocks of the given resources as failed and counts the error once.
+func (s *scrapeStatus) failResources(resources []resourceMeta, reason string, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, rm := range resources {
+		s.failed[rm.settings.block] = true
+	}
+	s.budgetExhausted = s.budgetExhausted || err == errBudgetExhausted
+	scrapeErrors.WithLabelValues(reasonFor(reason, err)).Inc()
+}
+
+// exhaustedBudget returns whether a request failed because the API budget was exhausted.
+func (s *scrapeStatus) exhaustedBudget() bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.budgetExhausted
+}
+
+// collect sends the success of each block.
+func (s *scrapeStatus) collect(ch chan<- prometheus.Metric) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, block := range s.blocks {
+		success := 1.0
+		if s.failed[block] {
+			success = 0
+		}
+		ch <- prometheus.MustNewConstMetric(scrapeSuccessDesc, prometheus.GaugeValue, success, block)
+	}
+}
+
+// Returns the reason to report for an error, requests refused by the API budget having their own reason
+func reasonFor(reason string, err error) string {
+	if err == errBudgetExhausted {
+		return reasonBudgetExhausted
+	}
+	return reason
+}
+
+// Logs a failed request inside a batch, counts it and marks the block of its resource as failed.
+// A status code of 0 means the request got no response.
+func batchItemFailed(status *scrapeStatus, rm resourceMeta, reason string, statusCode int, message string) {
+	code := "none"
+	if statusCode != 0 {
+		code = strconv.Itoa(statusCode)
+	}
+	err := fmt.Errorf("Request for resource %s failed with status code %s: %s", rm.resourceID, code, message)
+	log.Println(err)
+	batchItemErrors.WithLabelValues(rm.settings.block, code).Inc()
+	status.fail(rm.settings.block, reason, err)
+}
+
+// Logs an authentication failure and counts it
+func authenticationFailed(err error) {
+	log.Println(err)
+	scrapeErrors.WithLabelValues(reasonAuthentication).Inc()
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestBatchCollectMetricsIsolatesFailures(t *testing.T) {
+	previousRetries := maxRetries
+	maxRetries = 0
+	defer func() { maxRetries = previousRetries }()
+
+	batches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		batches++
+		if batches == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "internal error")
+			return
+		}
+		// The request of the third block fails inside the batch
+		fmt.Fprint(w, `{"responses": [
+			{"name": "0", "httpStatusCode": 200, "content": {"value": []}},
+			{"name": "1", "httpStatusCode": 404, "content": {"error": {"message": "not found"}}}
+		]}`)
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL}
+	defer func() { sc.C = previous }()
+
+	first := &metricSettings{block: "resource_groups[0]"}
+	second := &metricSettings{block: "resource_groups[1]"}
+	third := &metricSettings{block: "resource_groups[2]"}
+	var resources []resourceMeta
+	for i := 0; i < batchSize; i++ {
+		resources = append(resources, resourceMeta{resourceID: fmt.Sprintf("/vm%d", i), settings: first})
+	}
+	resources = append(resources, resourceMeta{resourceID: "/vm", settings: second})
+	resources = append(resources, resourceMeta{resourceID: "/missing", settings: third})
+
+	status := newScrapeStatus(first.block, second.block, third.block)
+	ch := make(chan prometheus.Metric)
+	go func() {
+		(&Collector{}).batchCollectMetrics(ch, resources, status)
+		status.collect(ch)
+		close(ch)
+	}()
+
+	success := make(map[string]float64)
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		if m.Desc() == scrapeSuccessDesc {
+			success[pb.Label[0].GetValue()] = pb.GetGauge().GetValue()
+		}
+	}
+
+	if batches != 2 {
+		t.Errorf("doesn't send the batches following a failed one\ngot: %d batches\nwant: %d", batches, 2)
+	}
+	if success[first.block] != 0 || success[second.block] != 1 || success[third.block] != 0 {
+		t.Errorf("doesn't report the success of each block\ngot: %v", success)
+	}
+}
+
+func TestBatchLookupResourcesItemErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first lookup is not found, the second is missing from the response
+		fmt.Fprint(w, `{"responses": [
+			{"name": "2", "httpStatusCode": 200, "content": {"id": "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm2"}},
+			{"name": "0", "httpStatusCode": 404, "content": {"error": {"code": "ResourceNotFound", "message": "not found"}}}
+		]}`)
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL}
+	defer func() { sc.C = previous }()
+	previousVersions := ac.APIVersions
+	ac.APIVersions = APIVersionMap{"Microsoft.Compute/virtualMachines": "2019-07-01"}
+	defer func() { ac.APIVersions = previousVersions }()
+
+	settings := &metricSettings{block: "resource_tags[0]"}
+	var resources []resourceMeta
+	for i := 0; i < 3; i++ {
+		id := fmt.Sprintf("/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm%d", i)
+		resources = append(resources, resourceMeta{resourceID: id, subscription: "sub", resourceURL: "/subscriptions/sub" + id, settings: settings})
+	}
+
+	notFound := counterValue(t, batchItemErrors.WithLabelValues(settings.block, "404"))
+	missing := counterValue(t, batchItemErrors.WithLabelValues(settings.block, "none"))
+
+	found := (&Collector{}).batchLookupResources(resources, newScrapeStatus(settings.block))
+
+	if len(found) != 1 || found[0].resourceID != resources[2].resourceID || found[0].resource.ID == "" {
+		t.Errorf("doesn't keep only the resources looked up successfully\ngot: %v", found)
+	}
+	if got := counterValue(t, batchItemErrors.WithLabelValues(settings.block, "404")) - notFound; got != 1 {
+		t.Errorf("doesn't count failed lookups by status code\ngot: %v\nwant: %v", got, 1)
+	}
+	if got := counterValue(t, batchItemErrors.WithLabelValues(settings.block, "none")) - missing; got != 1 {
+		t.Errorf("doesn't count lookups missing from the batch response\ngot: %v\nwant: %v", got, 1)
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var pb dto.Metric
+	if err := c.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetCounter().GetValue()
+}
+
+// subscriptionsCollector collects the given resources in a single batch
+type subscriptionsCollector struct {
+	resources []resourceMeta
+}
+
+func (c *subscriptionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
+}
+
+func (c *subscriptionsCollector) Collect(ch chan<- prometheus.Metric) {
+	(&Collector{}).batchCollectMetrics(ch, c.resources, newScrapeStatus("targets[0]"))
+}
+
+func TestBatchCollectMetricsSubscriptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/batch") {
+			// No metric definitions
+			fmt.Fprint(w, `{"value": []}`)
+			return
+		}
+		content := `{"value": [{"name": {"value": "Percentage CPU"}, "unit": "Percent",
+			"timeseries": [{"data": [{"timeStamp": "2020-01-01T00:00:00Z", "average": 1}]}]}]}`
+		fmt.Fprintf(w, `{"responses": [{"name": "0", "httpStatusCode": 200, "content": %s},
+			{"name": "1", "httpStatusCode": 200, "content": %s}]}`, content, content)
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL}
+	defer func() { sc.C = previous }()
+
+	// The same resource name in two subscriptions
+	settings := &metricSettings{block: "targets[0]"}
+	id := "/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm"
+	var resources []resourceMeta
+	for _, subscription := range []string{"sub1", "sub2"} {
+		resources = append(resources, resourceMeta{
+			resourceID:   id,
+			subscription: subscription,
+			resourceURL:  resourceURLFrom(subscription, id, "Percentage CPU", nil, []string{"Average"}, queryWindow{}),
+			aggregations: []string{"Average"},
+			resource:     AzureResource{ID: "/subscriptions/" + subscription + id, Name: "vm"},
+			settings:     settings,
+		})
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&subscriptionsCollector{resources: resources})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("doesn't distinguish resources of the same name in different subscriptions: %v", err)
+	}
+
+	for _, family := range families {
+		subscriptions := make(map[string]bool)
+		for _, m := range family.Metric {
+			for _, label := range m.Label {
+				if label.GetName() == "azure_subscription" {
+					subscriptions[label.GetValue()] = true
+				}
+			}
+		}
+		if len(subscriptions) != 2 {
+			t.Errorf("doesn't label %s with the subscription of each resource\ngot: %v", family.GetName(), subscriptions)
+		}
+	}
+}
+
+func TestExtractMetricsDimensions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// No metric definitions
+		fmt.Fprint(w, `{"value": []}`)
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL}
+	defer func() { sc.C = previous }()
+
+	// More instances than the 10 timeseries Azure returns by default
+	id := "/resourceGroups/rg/providers/Microsoft.Web/sites/app"
+	dimensions := []string{"Instance"}
+	resourceURL := resourceURLFrom("sub", id, "CpuTime", dimensions, []string{"Total"}, queryWindow{})
+	if u, err := url.Parse(resourceURL); err != nil || u.Query().Get("top") != strconv.Itoa(maxDimensionSeries) {
+		t.Errorf("doesn't ask for every timeseries of the dimensions\ngot: %s", resourceURL)
+	}
+
+	var timeseries []string
+	for i := 0; i < 12; i++ {
+		timeseries = append(timeseries, fmt.Sprintf(`{"metadatavalues": [{"name": {"value": "Instance"}, "value": "instance%d"}],
+			"data": [{"timeStamp": "2020-01-01T00:00:00Z", "total": %d}]}`, i, i))
+	}
+	var response AzureMetricValueResponse
+	body := fmt.Sprintf(`{"value": [{"name": {"value": "CpuTime"}, "unit": "Seconds", "timeseries": [%s]}]}`, strings.Join(timeseries, ","))
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	rm := resourceMeta{
+		resourceID:   id,
+		subscription: "sub",
+		resourceURL:  resourceURL,
+		dimensions:   dimensions,
+		aggregations: []string{"Total"},
+		resource:     AzureResource{ID: "/subscriptions/sub" + id, Name: "app"},
+		settings:     &metricSettings{block: "targets[0]"},
+	}
+	ch := make(chan prometheus.Metric, 100)
+	(&Collector{}).extractMetrics(ch, rm, response, &publishedSet{keys: make(map[string]bool)})
+	close(ch)
+
+	values := make(map[string]float64)
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), "cputime_seconds_total") {
+			continue
+		}
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		for _, label := range pb.Label {
+			if label.GetName() == "instance" {
+				values[label.GetValue()] = pb.GetGauge().GetValue()
+			}
+		}
+	}
+	if len(values) != 12 {
+		t.Fatalf("doesn't export a series per dimension value\ngot: %v", values)
+	}
+	for i := 0; i < 12; i++ {
+		if got := values[fmt.Sprintf("instance%d", i)]; got != float64(i) {
+			t.Errorf("doesn't label the series of instance%d with its dimension\ngot: %v\nwant: %v", i, got, i)
+		}
+	}
+}
+
+// extractCollector exports the metrics of resources from their responses
+type extractCollector struct {
+	resources []resourceMeta
+	responses []AzureMetricValueResponse
+}
+
+func (c *extractCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- prometheus.NewDesc("dummy", "dummy", nil, nil)
+}
+
+func (c *extractCollector) Collect(ch chan<- prometheus.Metric) {
+	published := &publishedSet{keys: make(map[string]bool)}
+	for i, rm := range c.resources {
+		(&Collector{}).extractMetrics(ch, rm, c.responses[i], published)
+	}
+}
+
+func TestExtractMetricsSingleHelp(t *testing.T) {
+	previousRetries := maxRetries
+	maxRetries = 0
+	defer func() { maxRetries = previousRetries }()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The definitions of virtual machines fail, those of scale sets don't
+		if strings.Contains(r.URL.Path, "/virtualMachines/") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "bad request")
+			return
+		}
+		fmt.Fprint(w, `{"value": [{"name": {"value": "Percentage CPU"}, "unit": "Percent"}]}`)
+	}))
+	defer server.Close()
+
+	previous := sc.C
+	sc.C = &config.Config{ResourceManagerURL: server.URL}
+	defer func() { sc.C = previous }()
+	previousDefinitions := ac.metricDefinitions
+	ac.metricDefinitions = make(map[string]*definitionsCall)
+	defer func() { ac.metricDefinitions = previousDefinitions }()
+	previousHelps := metricHelps
+	metricHelps = &helpTexts{texts: make(map[string]string)}
+	defer func() { metricHelps = previousHelps }()
+
+	var response AzureMetricValueResponse
+	body := `{"value": [{"name": {"value": "Percentage CPU"}, "unit": "Percent",
+		"timeseries": [{"data": [{"timeStamp": "2020-01-01T00:00:00Z", "average": 1}]}]}]}`
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &extractCollector{}
+	settings := &metricSettings{block: "targets[0]"}
+	for _, id := range []string{
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss",
+	} {
+		c.resources = append(c.resources, resourceMeta{
+			resourceID:   id,
+			subscription: "sub",
+			resourceURL:  resourceURLFrom("sub", id, "Percentage CPU", nil, []string{"Average"}, queryWindow{}),
+			aggregations: []string{"Average"},
+			resource:     AzureResource{ID: "/subscriptions/sub" + id},
+			settings:     settings,
+		})
+		c.responses = append(c.responses, response)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	if _, err := registry.Gather(); err != nil {
+		t.Errorf("doesn't export a single help text per metric name: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Tokens are refreshed by requests once they expire within tokenRefreshMargin, and renewed in the background
+	// tokenRenewBefore their expiry so that requests don't have to wait for them
+	tokenRefreshMargin = 10 * time.Minute
+	tokenRenewBefore   = 15 * time.Minute
+	tokenRenewRetry    = time.Minute
+
+	tokenExpiryGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "azure_access_token_expiry_timestamp_seconds",
+		Help: "Expiry of the current access token, by audience",
+	}, []string{"audience"})
+)
+
+// tokenSource holds the access token of an audience, refreshing it before it expires. It is safe for concurrent
+// use, concurrent callers sharing a single refresh. A nil token source returns an empty token.
+type tokenSource struct {
+	credentials credentialProvider
+	audience    string
+	retry       time.Duration
+
+	mtx         sync.Mutex
+	token       accessToken
+	lastAttempt time.Time
+	pending     *tokenRefresh
+}
+
+// tokenRefresh is a refresh in flight, whose result is shared by its callers once done is closed.
+type tokenRefresh struct {
+	done  chan struct{}
+	token accessToken
+	err   error
+}
+
+func newTokenSource(credentials credentialProvider, audience string) *tokenSource {
+	return &tokenSource{credentials: credentials, audience: audience, retry: tokenRenewRetry}
+}
+
+// get returns the current token, refreshing it first if it expires within tokenRefreshMargin.
+// Providers such as the Azure CLI and managed identities keep returning their cached token until shortly before it
+// expires, so a valid token is not refreshed again until the retry delay after the last attempt.
+func (s *tokenSource) get() (string, error) {
+	if s == nil {
+		return "", nil
+	}
+
+	s.mtx.Lock()
+	now := time.Now()
+	fresh := now.Before(s.token.expiresOn.Add(-tokenRefreshMargin))
+	throttled := now.Before(s.token.expiresOn) && now.Sub(s.lastAttempt) < s.retry
+	if fresh || throttled {
+		token := s.token.token
+		s.mtx.Unlock()
+		return token, nil
+	}
+	s.mtx.Unlock()
+
+	token, err := s.refresh()
+	return token.token, err
+}
+
+// refresh gets a new token, or waits for the refresh already in flight, and returns the current token.
+// A failed refresh, or one returning a token expiring no later than the current one, keeps the current token.
+func (s *tokenSource) refresh() (accessToken, error) {
+	s.mtx.Lock()
+	call := s.pending
+	if call == nil {
+		call = &tokenRefresh{done: make(chan struct{})}
+		s.pending = call
+		s.lastAttempt = time.Now()
+		s.mtx.Unlock()
+
+		token, err := s.credentials.getToken(s.audience)
+
+		s.mtx.Lock()
+		if err == nil && token.expiresOn.After(s.token.expiresOn) {
+			s.token = token
+			tokenExpiryGauge.WithLabelValues(s.audience).Set(float64(token.expiresOn.Unix()))
+		}
+		call.token, call.err = s.token, err
+		s.pending = nil
+		s.mtx.Unlock()
+		close(call.done)
+		return call.token, call.err
+	}
+	s.mtx.Unlock()
+
+	<-call.done
+	return call.token, call.err
+}
+
+// renew refreshes the token tokenRenewBefore its expiry until stop is closed, waiting at least the retry delay
+// between attempts.
+func (s *tokenSource) renew(stop <-chan struct{}) {
+	for {
+		s.mtx.Lock()
+		expiresOn := s.token.expiresOn
+		s.mtx.Unlock()
+
+		delay := time.Until(expiresOn.Add(-tokenRenewBefore))
+		if delay < s.retry {
+			delay = s.retry
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+
+		token, err := s.refresh()
+		if err != nil {
+			log.Printf("Failed to renew access token for %s, retrying in %s: %v", s.audience, s.retry, err)
+		} else if !token.expiresOn.After(expiresOn) {
+			log.Printf("Access token for %s was not renewed yet, retrying in %s", s.audience, s.retry)
+		}
+	}
+}
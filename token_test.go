@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCredential returns tokens numbered by call, expiring after a fixed duration
+type fakeCredential struct {
+	mtx      sync.Mutex
+	calls    int
+	lifetime time.Duration
+}
+
+func (f *fakeCredential) getToken(resource string) (accessToken, error) {
+	time.Sleep(10 * time.Millisecond)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.calls++
+	return accessToken{token: fmt.Sprintf("token%d", f.calls), expiresOn: time.Now().Add(f.lifetime)}, nil
+}
+
+func TestTokenSourceSingleFlight(t *testing.T) {
+	credential := &fakeCredential{lifetime: time.Hour}
+	source := newTokenSource(credential, "https://management.azure.com/")
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := source.get()
+			if err != nil {
+				t.Error(err)
+			}
+			tokens[i] = token
+		}(i)
+	}
+	wg.Wait()
+
+	if credential.calls != 1 {
+		t.Errorf("doesn't share a single refresh between concurrent callers\ngot: %d token requests\nwant: %d", credential.calls, 1)
+	}
+	for _, token := range tokens {
+		if token != "token1" {
+			t.Errorf("doesn't return the refreshed token\ngot: %s\nwant: %s", token, "token1")
+		}
+	}
+}
+
+func TestTokenSourceRefreshesBeforeExpiry(t *testing.T) {
+	var cases = []struct {
+		lifetime time.Duration
+		want     string
+	}{
+		{time.Hour, "token1"},
+		// Expiring within the refresh margin
+		{tokenRefreshMargin / 2, "token2"},
+	}
+
+	for _, c := range cases {
+		source := newTokenSource(&fakeCredential{lifetime: c.lifetime}, "https://management.azure.com/")
+		source.retry = 0
+		if _, err := source.get(); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := source.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("doesn't refresh tokens expiring within %s\ngot: %s\nwant: %s", tokenRefreshMargin, got, c.want)
+		}
+	}
+}
+
+// cachedCredential keeps returning the same short-lived token, as the Azure CLI does until its cache rolls over
+type cachedCredential struct {
+	mtx   sync.Mutex
+	calls int
+	token accessToken
+}
+
+func (c *cachedCredential) getToken(resource string) (accessToken, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.calls++
+	return c.token, nil
+}
+
+func (c *cachedCredential) callCount() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.calls
+}
+
+func TestTokenSourceShortLivedToken(t *testing.T) {
+	credential := &cachedCredential{token: accessToken{token: "cached", expiresOn: time.Now().Add(tokenRefreshMargin / 2)}}
+	source := newTokenSource(credential, "https://management.azure.com/")
+	source.retry = 20 * time.Millisecond
+
+	for i := 0; i < 10; i++ {
+		token, err := source.get()
+		if err != nil || token != "cached" {
+			t.Fatalf("doesn't return the valid token\ngot: %s, %v", token, err)
+		}
+	}
+	if calls := credential.callCount(); calls != 1 {
+		t.Errorf("doesn't wait for the retry delay before refreshing a token that was not renewed\ngot: %d token requests\nwant: %d", calls, 1)
+	}
+
+	stop := make(chan struct{})
+	go source.renew(stop)
+	time.Sleep(110 * time.Millisecond)
+	close(stop)
+
+	if calls := credential.callCount(); calls > 8 {
+		t.Errorf("doesn't wait for the retry delay between renewals\ngot: %d token requests in 110ms", calls)
+	}
+}
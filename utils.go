@@ -6,11 +6,19 @@ import (
 	"log"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/common/model"
 )
 
 var (
+	// Maximum number of metric names the Azure metrics API accepts in a request
+	maxMetricsPerRequest = 20
+
 	// resource component positions in a ResourceURL
 	resourceGroupPosition      = 4
 	resourceNamePosition       = 8
@@ -19,8 +27,21 @@ var (
 	resourceTypePosition       = 7
 	resourceTypePrefixPosition = 6
 	invalidLabelChars          = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+	invalidMetricChars         = regexp.MustCompile("[^a-zA-Z0-9_:]")
+	camelCaseBoundary          = regexp.MustCompile(`([a-z])([A-Z])`)
+	acronymBoundary            = regexp.MustCompile(`([A-Z0-9])([A-Z][a-z])`)
+	iso8601Duration            = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
 )
 
+// metricHelp returns the help text of an exported series from the definition of its Azure metric.
+func metricHelp(def metricDefinitionResponse, resourceType string, aggregation string) string {
+	name := def.Name.LocalizedValue
+	if name == "" {
+		name = def.Name.Value
+	}
+	return fmt.Sprintf("%s (%s, unit: %s) of Azure resource type %s", name, aggregation, def.Unit, resourceType)
+}
+
 // PrintPrettyJSON - Prints structs nicely for debugging.
 func PrintPrettyJSON(input map[string]interface{}) {
 	out, err := json.MarshalIndent(input, "", "\t")
@@ -31,16 +52,103 @@ func PrintPrettyJSON(input map[string]interface{}) {
 }
 
 // GetTimes - Returns the endTime and startTime used for querying Azure Metrics API
-func GetTimes() (string, string) {
+func GetTimes(timespan time.Duration, delay time.Duration) (string, string) {
 	// Make sure we are using UTC
 	now := time.Now().UTC()
 
-	// Use query delay of 3 minutes when querying for latest metric data
-	endTime := now.Add(time.Minute * time.Duration(-3)).Format(time.RFC3339)
-	startTime := now.Add(time.Minute * time.Duration(-4)).Format(time.RFC3339)
+	// Use query delay when querying for latest metric data, as Azure ingests metrics with some latency
+	endTime := now.Add(-delay).Format(time.RFC3339)
+	startTime := now.Add(-delay - timespan).Format(time.RFC3339)
 	return endTime, startTime
 }
 
+// queryWindow defines the time grain and the time range of a metrics query
+type queryWindow struct {
+	interval time.Duration
+	timespan time.Duration
+	delay    time.Duration
+}
+
+// queryWindowFrom returns the query window of a configuration block, falling back to the global settings.
+func queryWindowFrom(interval model.Duration, timespan model.Duration, delay *model.Duration) queryWindow {
+	i, t, d := sc.C.QueryWindow(interval, timespan, delay)
+	return queryWindow{
+		interval: time.Duration(i),
+		timespan: time.Duration(t),
+		delay:    time.Duration(d),
+	}
+}
+
+// formatISO8601Duration returns the ISO 8601 representation of a duration, as used by Azure for time grains.
+func formatISO8601Duration(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("P%dD", d/(24*time.Hour))
+	}
+
+	var str strings.Builder
+	str.WriteString("PT")
+	if h := d / time.Hour; h > 0 {
+		fmt.Fprintf(&str, "%dH", h)
+	}
+	if m := d % time.Hour / time.Minute; m > 0 {
+		fmt.Fprintf(&str, "%dM", m)
+	}
+	if s := d % time.Minute / time.Second; s > 0 {
+		fmt.Fprintf(&str, "%dS", s)
+	}
+	return str.String()
+}
+
+// parseISO8601Duration parses the days, hours, minutes and seconds of an ISO 8601 duration.
+func parseISO8601Duration(value string) (time.Duration, error) {
+	matches := iso8601Duration.FindStringSubmatch(value)
+	if matches == nil || value == "P" || value == "PT" {
+		return 0, fmt.Errorf("Invalid ISO 8601 duration: %q", value)
+	}
+
+	var d time.Duration
+	for i, unit := range []time.Duration{24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if matches[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(matches[i+1])
+		if err != nil {
+			return 0, fmt.Errorf("Invalid ISO 8601 duration: %q", value)
+		}
+		d += time.Duration(n) * unit
+	}
+	return d, nil
+}
+
+// ParseProbeTarget - Returns the subscription, resource ID or resource group of a probe target.
+// Targets are either a resource ID or a resource group, optionally prefixed by /subscriptions/<subscription_id>.
+// A resource group can also be given by its name only.
+func ParseProbeTarget(target string) (subscription string, resourceID string, resourceGroup string, err error) {
+	target = strings.TrimSuffix(target, "/")
+	if !strings.HasPrefix(target, "/") {
+		if len(target) == 0 || strings.Contains(target, "/") {
+			return "", "", "", fmt.Errorf("Invalid probe target %q", target)
+		}
+		return "", "", target, nil
+	}
+
+	parts := strings.Split(target, "/")
+	if len(parts) >= 3 && strings.EqualFold(parts[1], "subscriptions") {
+		subscription = parts[2]
+		parts = append([]string{""}, parts[3:]...)
+	}
+
+	switch {
+	case len(parts) == 3 && strings.EqualFold(parts[1], "resourceGroups"):
+		resourceGroup = parts[2]
+	case len(parts) >= 7 && strings.EqualFold(parts[1], "resourceGroups") && strings.EqualFold(parts[3], "providers"):
+		resourceID = strings.Join(parts, "/")
+	default:
+		return "", "", "", fmt.Errorf("Invalid probe target %q", target)
+	}
+	return subscription, resourceID, resourceGroup, nil
+}
+
 // CreateResourceLabels - Returns resource labels for a given resource URL.
 func CreateResourceLabels(resourceURL string) map[string]string {
 	labels := make(map[string]string)
@@ -54,6 +162,17 @@ func CreateResourceLabels(resourceURL string) map[string]string {
 	return labels
 }
 
+// Returns the resource group of a resource ID, with or without the subscription prefix
+func resourceGroupOf(resourceID string) string {
+	parts := strings.Split(resourceID, "/")
+	for i := 0; i < len(parts)-1; i++ {
+		if strings.EqualFold(parts[i], "resourceGroups") {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
 // GetResourceType returns the resource type with the namespace
 func GetResourceType(resourceURL string) string {
 	resource := strings.Split(resourceURL, "/")
@@ -97,9 +216,114 @@ func CreateAllResourceLabelsFrom(rm resourceMeta) map[string]string {
 	for k, v := range resourceLabels {
 		labels[k] = v
 	}
+	if rm.subscription != "" {
+		labels["azure_subscription"] = rm.subscription
+	}
 	return labels
 }
 
+// Suffixes of the exported series for each aggregation, with the azure and prometheus metric naming
+var aggregationSuffixes = []struct {
+	name             string
+	suffix           string
+	prometheusSuffix string
+}{
+	{"Total", "_total", "_total_value"},
+	{"Average", "_average", "_average"},
+	{"Minimum", "_min", "_min"},
+	{"Maximum", "_max", "_max"},
+	{"Count", "_count", "_samples"},
+}
+
+// Suffix and scale converting the values of each Azure unit to its Prometheus base unit, and the unit or rate
+// words Azure metric names may already end with, such as Bytes/sec, which the suffix replaces
+var unitConversions = map[string]struct {
+	suffix string
+	scale  float64
+	words  *regexp.Regexp
+}{
+	"count":          {"", 1, nil},
+	"bytes":          {"_bytes", 1, regexp.MustCompile(`_bytes$`)},
+	"seconds":        {"_seconds", 1, regexp.MustCompile(`_(seconds|secs)$`)},
+	"milliseconds":   {"_seconds", 1e-3, regexp.MustCompile(`_(milliseconds|ms)$`)},
+	"countpersecond": {"_per_second", 1, regexp.MustCompile(`(_per)?_(second|sec)$`)},
+	"bytespersecond": {"_bytes_per_second", 1, regexp.MustCompile(`_bytes((_per)?_(second|sec))?$|(_per)?_(second|sec)$`)},
+	"bitspersecond":  {"_bytes_per_second", 1.0 / 8, regexp.MustCompile(`_bits((_per)?_(second|sec))?$|(_per)?_(second|sec)$`)},
+	"byteseconds":    {"_byte_seconds", 1, regexp.MustCompile(`_byte_seconds$`)},
+	"percent":        {"_ratio", 1e-2, regexp.MustCompile(`_(percent|percentage)$`)},
+	"cores":          {"_cores", 1, regexp.MustCompile(`_cores$`)},
+	"millicores":     {"_cores", 1e-3, regexp.MustCompile(`_millicores$`)},
+	"nanocores":      {"_cores", 1e-9, regexp.MustCompile(`_nanocores$`)},
+	"unspecified":    {"", 1, nil},
+}
+
+// exportedMetricName returns the name of the series exported for an aggregation of an Azure metric,
+// and the scale to apply to its values, according to the configured metric naming.
+// When rename is set, it replaces the part of the name built from the Azure metric name and unit.
+func exportedMetricName(azureName string, unit string, aggregation string, rename string) (string, float64) {
+	var name string
+	scale := 1.0
+	if sc.C.MetricNaming == config.PrometheusMetricNaming {
+		name, scale = prometheusMetricName(azureName, unit, aggregation, rename)
+	} else {
+		name = azureMetricName(azureName, unit, aggregation, rename)
+	}
+
+	if sc.C.MetricNamespace != "" {
+		name = sc.C.MetricNamespace + "_" + name
+	}
+	return name, scale
+}
+
+// azureMetricName returns the metric name built from the Azure metric name, its raw unit and the aggregation.
+func azureMetricName(azureName string, unit string, aggregation string, rename string) string {
+	// Ensure Azure metric names conform to Prometheus metric name conventions
+	metricName := strings.Replace(azureName, " ", "_", -1)
+	metricName = strings.ToLower(metricName + "_" + unit)
+	metricName = strings.Replace(metricName, "/", "_per_", -1)
+	metricName = invalidMetricChars.ReplaceAllString(metricName, "_")
+	if rename != "" {
+		metricName = rename
+	}
+
+	for _, a := range aggregationSuffixes {
+		if a.name == aggregation {
+			metricName += a.suffix
+		}
+	}
+	return metricName
+}
+
+// prometheusMetricName returns a metric name following the Prometheus naming conventions, with a base unit suffix,
+// and the scale converting values to that base unit. The Count aggregation is a number of samples, without unit.
+func prometheusMetricName(azureName string, unit string, aggregation string, rename string) (string, float64) {
+	metricName := camelCaseBoundary.ReplaceAllString(azureName, "${1}_${2}")
+	metricName = acronymBoundary.ReplaceAllString(metricName, "${1}_${2}")
+	metricName = invalidLabelChars.ReplaceAllString(metricName, "_")
+	metricName = strings.ToLower(strings.Trim(metricName, "_"))
+
+	scale := 1.0
+	if aggregation != "Count" {
+		if conversion, ok := unitConversions[strings.ToLower(unit)]; ok {
+			if conversion.words != nil {
+				metricName = conversion.words.ReplaceAllString(metricName, "")
+			}
+			metricName += conversion.suffix
+			scale = conversion.scale
+		}
+	}
+	if rename != "" {
+		metricName = rename
+	}
+
+	for _, a := range aggregationSuffixes {
+		if a.name == aggregation {
+			metricName += a.prometheusSuffix
+		}
+	}
+	return metricName, scale
+}
+
 func hasAggregation(aggregations []string, aggregation string) bool {
 	if len(aggregations) == 0 {
 		return true
@@ -120,3 +344,94 @@ func filterAggregations(aggregations []string) []string {
 	}
 	return base
 }
+
+// metricGroup holds the metric names sharing the same dimensions and time grain, which can be queried together.
+type metricGroup struct {
+	names      string
+	dimensions []string
+	timeGrain  time.Duration
+}
+
+// groupMetrics groups metrics by their dimensions, as the Azure $filter applies to all metrics of a request, and by
+// their time grain, as Azure rejects requests mixing metrics of different time grains. Metrics missing from
+// timeGrains use the default time grain. Groups are split into chunks of at most maxMetricsPerRequest names.
+func groupMetrics(metrics []config.Metric, timeGrains map[string]time.Duration) []metricGroup {
+	var groups []metricGroup
+	var names [][]string
+	index := make(map[string]int)
+
+	for _, metric := range metrics {
+		timeGrain := timeGrains[metric.Name]
+		key := fmt.Sprintf("%s/%s", strings.Join(metric.Dimensions, ","), timeGrain)
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, metricGroup{dimensions: metric.Dimensions, timeGrain: timeGrain})
+			names = append(names, nil)
+		}
+		names[i] = append(names[i], metric.Name)
+	}
+
+	var chunks []metricGroup
+	for i, group := range groups {
+		for j := 0; j < len(names[i]); j += maxMetricsPerRequest {
+			k := j + maxMetricsPerRequest
+			if k > len(names[i]) {
+				k = len(names[i])
+			}
+			group.names = strings.Join(names[i][j:k], ",")
+			chunks = append(chunks, group)
+		}
+	}
+	return chunks
+}
+
+// dimensionLabelName returns a valid Prometheus label name for an Azure metric dimension.
+func dimensionLabelName(dimension string) string {
+	return invalidLabelChars.ReplaceAllString(strings.ToLower(dimension), "_")
+}
+
+// resourceQueryLabels returns a label for each projected column of a resource query row with a scalar value,
+// except the resource ID.
+func resourceQueryLabels(row map[string]interface{}) map[string]string {
+	labels := make(map[string]string)
+	for column, value := range row {
+		if strings.EqualFold(column, "id") {
+			continue
+		}
+		name := dimensionLabelName(column)
+		switch v := value.(type) {
+		case string:
+			labels[name] = v
+		case float64:
+			labels[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			labels[name] = strconv.FormatBool(v)
+		}
+	}
+	return labels
+}
+
+// Returns the aggregations to query for the given metrics, falling back to the default aggregations
+// for metrics without a known primary aggregation
+func aggregationsFor(metricNames []string, primaryAggregations map[string]string) []string {
+	needed := make(map[string]bool)
+	for _, name := range metricNames {
+		if primary, ok := primaryAggregations[strings.ToLower(name)]; ok {
+			needed[primary] = true
+			continue
+		}
+		for _, aggregation := range filterAggregations(nil) {
+			needed[aggregation] = true
+		}
+	}
+
+	var aggregations []string
+	for _, aggregation := range aggregationSuffixes {
+		if needed[aggregation.name] {
+			aggregations = append(aggregations, aggregation.name)
+		}
+	}
+	return aggregations
+}
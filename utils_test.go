@@ -1,8 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v2"
 )
 
 func TestCreateResourceLabels(t *testing.T) {
@@ -92,3 +100,269 @@ func TestCetResourceType(t *testing.T) {
 		}
 	}
 }
+
+func TestGroupMetrics(t *testing.T) {
+	metrics := []config.Metric{
+		{Name: "BytesReceived"},
+		{Name: "Http5xx", Dimensions: []string{"Instance"}},
+		{Name: "BytesSent"},
+		{Name: "Http2xx", Dimensions: []string{"Instance"}},
+		{Name: "Transactions", Dimensions: []string{"ApiName", "ResponseType"}},
+	}
+	want := []metricGroup{
+		{names: "BytesReceived,BytesSent"},
+		{names: "Http5xx,Http2xx", dimensions: []string{"Instance"}},
+		{names: "Transactions", dimensions: []string{"ApiName", "ResponseType"}},
+	}
+
+	got := groupMetrics(metrics, nil)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't group metrics by dimensions\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestGroupMetricsByTimeGrain(t *testing.T) {
+	metrics := []config.Metric{
+		{Name: "BytesReceived"},
+		{Name: "UsedCapacity"},
+		{Name: "BytesSent"},
+		{Name: "BlobCount"},
+	}
+	timeGrains := map[string]time.Duration{"UsedCapacity": time.Hour, "BlobCount": time.Hour}
+	want := []metricGroup{
+		{names: "BytesReceived,BytesSent"},
+		{names: "UsedCapacity,BlobCount", timeGrain: time.Hour},
+	}
+
+	got := groupMetrics(metrics, timeGrains)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't group metrics by time grain\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestGroupMetricsChunks(t *testing.T) {
+	var metrics []config.Metric
+	var names []string
+	for i := 0; i < 45; i++ {
+		name := fmt.Sprintf("Metric%d", i)
+		metrics = append(metrics, config.Metric{Name: name})
+		names = append(names, name)
+	}
+	want := []metricGroup{
+		{names: strings.Join(names[0:20], ",")},
+		{names: strings.Join(names[20:40], ",")},
+		{names: strings.Join(names[40:45], ",")},
+	}
+
+	got := groupMetrics(metrics, nil)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't split metrics into chunks of %d names\ngot: %v\nwant: %v", maxMetricsPerRequest, got, want)
+	}
+}
+
+func TestDimensionLabelName(t *testing.T) {
+	var cases = []struct {
+		dimension string
+		want      string
+	}{
+		{"ApiName", "apiname"},
+		{"Instance", "instance"},
+		{"Queue Name", "queue_name"},
+		{"microsoft.resourceid", "microsoft_resourceid"},
+	}
+
+	for _, c := range cases {
+		got := dimensionLabelName(c.dimension)
+
+		if got != c.want {
+			t.Errorf("doesn't create expected dimension label\ngot: %v\nwant: %v", got, c.want)
+		}
+	}
+}
+
+func TestParseProbeTarget(t *testing.T) {
+	var cases = []struct {
+		target        string
+		subscription  string
+		resourceID    string
+		resourceGroup string
+		valid         bool
+	}{
+		{
+			"/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+			"", "/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01", "", true,
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-002/providers/Microsoft.Sql/servers/sqlprod/databases/prod-db-01",
+			"abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6", "/resourceGroups/prod-rg-002/providers/Microsoft.Sql/servers/sqlprod/databases/prod-db-01", "", true,
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/",
+			"abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6", "", "prod-rg-001", true,
+		},
+		{"/resourceGroups/prod-rg-001", "", "", "prod-rg-001", true},
+		{"prod-rg-001", "", "", "prod-rg-001", true},
+		{"prod-rg-001/prod-vm-01", "", "", "", false},
+		{"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6", "", "", "", false},
+		{"/resourceGroups/prod-rg-001/virtualMachines/prod-vm-01", "", "", "", false},
+	}
+
+	for _, c := range cases {
+		subscription, resourceID, resourceGroup, err := ParseProbeTarget(c.target)
+
+		if c.valid != (err == nil) {
+			t.Errorf("unexpected error for target %s: %v", c.target, err)
+			continue
+		}
+		if subscription != c.subscription || resourceID != c.resourceID || resourceGroup != c.resourceGroup {
+			t.Errorf("doesn't parse expected probe target %s\ngot: %q %q %q\nwant: %q %q %q", c.target,
+				subscription, resourceID, resourceGroup, c.subscription, c.resourceID, c.resourceGroup)
+		}
+	}
+}
+
+func TestQueryWindowFrom(t *testing.T) {
+	previous := sc.C
+	sc.C = &config.Config{Delay: model.Duration(3 * time.Minute)}
+	defer func() { sc.C = previous }()
+
+	var cases = []struct {
+		block string
+		delay time.Duration
+	}{
+		{"resource: vm", 3 * time.Minute},
+		{"{resource: vm, delay: 5m}", 5 * time.Minute},
+		{"{resource: vm, delay: 0s}", 0},
+	}
+
+	for _, c := range cases {
+		var target config.Target
+		if err := yaml.Unmarshal([]byte(c.block), &target); err != nil {
+			t.Fatal(err)
+		}
+		window := queryWindowFrom(target.Interval, target.Timespan, target.Delay)
+		if window.delay != c.delay {
+			t.Errorf("doesn't query with expected delay for %s\ngot: %v\nwant: %v", c.block, window.delay, c.delay)
+		}
+	}
+}
+
+func TestISO8601Durations(t *testing.T) {
+	var cases = []struct {
+		iso      string
+		duration time.Duration
+	}{
+		{"PT1M", time.Minute},
+		{"PT5M", 5 * time.Minute},
+		{"PT1H", time.Hour},
+		{"PT1H30M", 90 * time.Minute},
+		{"PT12H", 12 * time.Hour},
+		{"P1D", 24 * time.Hour},
+		{"PT30S", 30 * time.Second},
+	}
+
+	for _, c := range cases {
+		got, err := parseISO8601Duration(c.iso)
+		if err != nil || got != c.duration {
+			t.Errorf("doesn't parse expected duration from %s\ngot: %v (%v)\nwant: %v", c.iso, got, err, c.duration)
+		}
+
+		if iso := formatISO8601Duration(c.duration); iso != c.iso {
+			t.Errorf("doesn't format expected duration from %v\ngot: %s\nwant: %s", c.duration, iso, c.iso)
+		}
+	}
+
+	for _, invalid := range []string{"", "P", "PT", "1M", "PT1Y", "P1W"} {
+		if _, err := parseISO8601Duration(invalid); err == nil {
+			t.Errorf("expected error parsing %q", invalid)
+		}
+	}
+}
+
+func TestAggregationsFor(t *testing.T) {
+	primaryAggregations := map[string]string{
+		"percentage cpu": "Average",
+		"network in":     "Total",
+		"disk read ops":  "Average",
+	}
+
+	var cases = []struct {
+		metrics []string
+		want    []string
+	}{
+		{[]string{"Percentage CPU"}, []string{"Average"}},
+		{[]string{"Percentage CPU", "Network In", "Disk Read Ops"}, []string{"Total", "Average"}},
+		{[]string{"Percentage CPU", "Unknown"}, []string{"Total", "Average", "Minimum", "Maximum"}},
+	}
+
+	for _, c := range cases {
+		got := aggregationsFor(c.metrics, primaryAggregations)
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("doesn't return expected aggregations for %v\ngot: %v\nwant: %v", c.metrics, got, c.want)
+		}
+	}
+}
+
+func TestMetricHelp(t *testing.T) {
+	var def metricDefinitionResponse
+	def.Name.Value = "Http5xx"
+	def.Name.LocalizedValue = "Http Server Errors"
+	def.Unit = "Count"
+
+	want := "Http Server Errors (Total, unit: Count) of Azure resource type Microsoft.Web/sites"
+	got := metricHelp(def, "Microsoft.Web/sites", "Total")
+	if got != want {
+		t.Errorf("doesn't create expected help\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestPrometheusMetricName(t *testing.T) {
+	var cases = []struct {
+		azureName   string
+		unit        string
+		aggregation string
+		name        string
+		scale       float64
+	}{
+		{"Percentage CPU", "Percent", "Average", "percentage_cpu_ratio_average", 1e-2},
+		{"BytesReceived", "Bytes", "Total", "bytes_received_bytes_total_value", 1},
+		{"AverageResponseTime", "Seconds", "Maximum", "average_response_time_seconds_max", 1},
+		{"SuccessE2ELatency", "MilliSeconds", "Average", "success_e2e_latency_seconds_average", 1e-3},
+		{"CPUCreditsConsumed", "Count", "Total", "cpu_credits_consumed_total_value", 1},
+		{"Http5xx", "Count", "Count", "http5xx_samples", 1},
+		{"Disk Read Bytes/sec", "BytesPerSecond", "Minimum", "disk_read_bytes_per_second_min", 1},
+		{"Requests/Sec", "CountPerSecond", "Average", "requests_per_second_average", 1},
+		{"Memory Percentage", "Percent", "Maximum", "memory_ratio_max", 1e-2},
+		{"Response Time Seconds", "Seconds", "Average", "response_time_seconds_average", 1},
+		{"Network In Total", "Bytes", "Average", "network_in_total_bytes_average", 1},
+		{"Response Time", "MilliSeconds", "Count", "response_time_samples", 1},
+		{"IngressBits", "BitsPerSecond", "Average", "ingress_bytes_per_second_average", 1.0 / 8},
+		{"Cpu90Percentile", "Percent", "Maximum", "cpu90_percentile_ratio_max", 1e-2},
+	}
+
+	for _, c := range cases {
+		name, scale := prometheusMetricName(c.azureName, c.unit, c.aggregation, "")
+
+		if name != c.name || scale != c.scale {
+			t.Errorf("doesn't create expected metric name for %s\ngot: %v %v\nwant: %v %v", c.azureName, name, scale, c.name, c.scale)
+		}
+	}
+}
+
+func TestResourceQueryLabels(t *testing.T) {
+	row := map[string]interface{}{
+		"id":            "/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Sql/servers/sqlprod/databases/prod-db-01",
+		"env":           "prod",
+		"skuCapacity":   float64(10),
+		"zoneRedundant": true,
+		"tags":          map[string]interface{}{"env": "prod"},
+		"unset":         nil,
+	}
+	want := map[string]string{"env": "prod", "skucapacity": "10", "zoneredundant": "true"}
+
+	got := resourceQueryLabels(row)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't create expected resource query labels\ngot: %v\nwant: %v", got, want)
+	}
+}